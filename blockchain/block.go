@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"encoding/binary"
 	"bytes"
+	"errors"
 )
 
 // SHA-256 outputs 256 bits (32 bytes)
@@ -25,27 +26,52 @@ func (block Block) Hash() HashVal {
 	return sha256.Sum256(buffer.Bytes())
 }
 
+// identifies the block in the network. Unlike Hash, it covers all the fields of the block
+func (block Block) Id() HashVal {
+	return sha256.Sum256(block.Bytes())
+}
+
+func HashValFromString(str string) (HashVal, error) {
+	hashVal := HashVal{}
+	bin, err := hex.DecodeString(str)
+	if err != nil {
+		return hashVal, err
+	}
+	if len(bin) != len(hashVal) {
+		return hashVal, errors.New("Invalid hash length")
+	}
+	copy(hashVal[:], bin)
+	return hashVal, nil
+}
+
 func (hashVal HashVal) String() string {
 	return hex.EncodeToString(hashVal[:])
 }
 
 func (block Block) String() string {
+	return hex.EncodeToString(block.Bytes())
+}
+
+func (block Block) Bytes() []byte {
 	buffer := bytes.Buffer{}
 	binary.Write(&buffer, binary.LittleEndian, block.Index)
 	binary.Write(&buffer, binary.LittleEndian, block.PreviousHash)
 	binary.Write(&buffer, binary.LittleEndian, block.Timestamp)
 	binary.Write(&buffer, binary.LittleEndian, block.DataLen)
 	binary.Write(&buffer, binary.LittleEndian, block.Data)
-	return hex.EncodeToString(buffer.Bytes())
+	return buffer.Bytes()
 }
 
 func BlockFromString(str string) (Block, error) {
-	block := Block{}
-
 	bin, err := hex.DecodeString(str)
 	if err != nil {
-		return block, err
+		return Block{}, err
 	}
+	return BlockFromBytes(bin)
+}
+
+func BlockFromBytes(bin []byte) (Block, error) {
+	block := Block{}
 
 	reader := bytes.NewReader(bin)
 	binary.Read(reader, binary.LittleEndian, &block.Index)
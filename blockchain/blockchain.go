@@ -1,6 +1,7 @@
 package blockchain
 
 import (
+	"bytes"
 	"fmt"
 	"sync"
 	"errors"
@@ -33,8 +34,25 @@ func NewFromBlock(block Block) *BlockChain {
 	}
 }
 
+// builds a blockchain from a list of consecutive blocks, starting with the genesis block
+func NewFromBlocks(blocks []Block) (*BlockChain, error) {
+	if len(blocks) == 0 || blocks[0].Index != 0 {
+		return nil, errors.New("Missing genesis block")
+	}
+	bc := NewFromBlock(blocks[0])
+	for _, block := range blocks[1:] {
+		_, err := bc.AddBlock(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bc, nil
+}
+
 func (bc *BlockChain) AddBlockFromData(timestamp int64, Data []byte) (int64, error) {
-	return bc.AddBlock(Block{
+	bc.Lock.Lock()
+	defer bc.Lock.Unlock()
+	return bc.addBlock(Block{
 		bc.NextIndex,
 		bc.LastHash,
 		timestamp,
@@ -46,6 +64,10 @@ func (bc *BlockChain) AddBlockFromData(timestamp int64, Data []byte) (int64, err
 func (bc *BlockChain) AddBlock(block Block) (int64, error) {
 	bc.Lock.Lock()
 	defer bc.Lock.Unlock()
+	return bc.addBlock(block)
+}
+
+func (bc *BlockChain) addBlock(block Block) (int64, error) {
 	if block.PreviousHash != bc.LastHash {
 		return -1, errors.New("Previous hash of the block doesn't match")
 	}
@@ -58,6 +80,142 @@ func (bc *BlockChain) AddBlock(block Block) (int64, error) {
 	return bc.NextIndex-1, nil
 }
 
+// the index of the next block and the hash of the last block
+func (bc *BlockChain) Tip() (int64, HashVal) {
+	bc.Lock.RLock()
+	defer bc.Lock.RUnlock()
+	return bc.NextIndex, bc.LastHash
+}
+
+// replaces the blocks with the ones of @other, which must not be used afterwards
+func (bc *BlockChain) Replace(other *BlockChain) {
+	bc.Lock.Lock()
+	bc.NextIndex, bc.LastHash, bc.Blocks = other.NextIndex, other.LastHash, other.Blocks
+	bc.Lock.Unlock()
+}
+
+// fork choice: whether a blockchain of @nextIndex blocks ending with the block @lastId is
+// preferred to one of @otherNextIndex blocks ending with @otherLastId. The longest
+// blockchain wins, and ties are broken by the lowest id of the last block, so that all
+// the nodes choose the same blockchain
+func Prefer(nextIndex int64, lastId HashVal, otherNextIndex int64, otherLastId HashVal) bool {
+	if nextIndex != otherNextIndex {
+		return nextIndex > otherNextIndex
+	}
+	return bytes.Compare(lastId[:], otherLastId[:]) < 0
+}
+
+// the id of the last block, false if the blockchain is empty
+func (bc *BlockChain) LastId() (HashVal, bool) {
+	bc.Lock.RLock()
+	defer bc.Lock.RUnlock()
+	if len(bc.Blocks) == 0 {
+		return HashVal{}, false
+	}
+	return bc.Blocks[len(bc.Blocks)-1].Id(), true
+}
+
+// ids of blocks from the last one back to the genesis block, with gaps that double after
+// the first ten blocks. A peer finds in it the last block both blockchains have in common
+func (bc *BlockChain) Locator() []HashVal {
+	bc.Lock.RLock()
+	defer bc.Lock.RUnlock()
+	locator := []HashVal{}
+	step := 1
+	for i := len(bc.Blocks) - 1; i > 0; i -= step {
+		locator = append(locator, bc.Blocks[i].Id())
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	if len(bc.Blocks) > 0 {
+		locator = append(locator, bc.Blocks[0].Id())
+	}
+	return locator
+}
+
+// at most @max blocks following the first block of @locator found in the blockchain,
+// starting from the genesis block if none is found
+func (bc *BlockChain) BlocksAfter(locator []HashVal, max int) []Block {
+	bc.Lock.RLock()
+	defer bc.Lock.RUnlock()
+	indexes := map[HashVal]int{}
+	for i, block := range bc.Blocks {
+		indexes[block.Id()] = i
+	}
+	start := 0
+	for _, id := range locator {
+		if i, ok := indexes[id]; ok {
+			start = i + 1
+			break
+		}
+	}
+	end := start + max
+	if end > len(bc.Blocks) {
+		end = len(bc.Blocks)
+	}
+	return append([]Block{}, bc.Blocks[start:end]...)
+}
+
+// switches to the branch formed by the blocks that precede @blocks followed by @blocks,
+// if Prefer chooses it. The branch must keep the genesis block of the blockchain, unless
+// the blockchain is empty. Returns the blocks of the current blockchain that are not in the
+// branch, and whether the blockchain switched to the branch
+func (bc *BlockChain) Reorganize(blocks []Block) ([]Block, bool, error) {
+	if len(blocks) == 0 {
+		return nil, false, nil
+	}
+	bc.Lock.Lock()
+	defer bc.Lock.Unlock()
+	fork := blocks[0].Index
+	for i, block := range blocks {
+		if block.Index != fork+int64(i) {
+			return nil, false, errors.New("The indexes of the blocks are not consecutive")
+		}
+	}
+	if fork == 0 && len(bc.Blocks) > 0 && blocks[0].Hash() != bc.Blocks[0].Hash() {
+		return nil, false, errors.New("The blocks don't share the genesis block of the blockchain")
+	}
+	if fork < 0 || fork > int64(len(bc.Blocks)) || fork > 0 && bc.Blocks[fork-1].Hash() != blocks[0].PreviousHash {
+		return nil, false, errors.New("The blocks don't fork from the blockchain")
+	}
+	branch, err := NewFromBlocks(append(append([]Block{}, bc.Blocks[:fork]...), blocks...))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(bc.Blocks) > 0 {
+		lastId := bc.Blocks[len(bc.Blocks)-1].Id()
+		if !Prefer(branch.NextIndex, blocks[len(blocks)-1].Id(), bc.NextIndex, lastId) {
+			return nil, false, nil
+		}
+	}
+
+	inBranch := map[HashVal]bool{}
+	for _, block := range blocks {
+		inBranch[block.Id()] = true
+	}
+	orphaned := []Block{}
+	for _, block := range bc.Blocks[fork:] {
+		if !inBranch[block.Id()] {
+			orphaned = append(orphaned, block)
+		}
+	}
+	bc.NextIndex, bc.LastHash, bc.Blocks = branch.NextIndex, branch.LastHash, branch.Blocks
+	return orphaned, true, nil
+}
+
+// whether a block of the blockchain has @data
+func (bc *BlockChain) HasData(data []byte) bool {
+	bc.Lock.RLock()
+	defer bc.Lock.RUnlock()
+	for _, block := range bc.Blocks {
+		if bytes.Equal(block.Data, data) {
+			return true
+		}
+	}
+	return false
+}
+
 func (bc *BlockChain) VerifyConsistency() bool {
 	// TODO verify if indexes follow 0, 1, 2 ...
 	// TODO verify if timestamps are non-decreasing
@@ -77,6 +235,27 @@ func (bc *BlockChain) VerifyConsistency() bool {
 	return true
 }
 
+// identifies the blockchain by the id of its genesis block
+func (bc *BlockChain) ChainId() (HashVal, bool) {
+	bc.Lock.RLock()
+	defer bc.Lock.RUnlock()
+	if len(bc.Blocks) == 0 {
+		return HashVal{}, false
+	}
+	return bc.Blocks[0].Id(), true
+}
+
+func (bc *BlockChain) FindBlock(id HashVal) (Block, bool) {
+	bc.Lock.RLock()
+	defer bc.Lock.RUnlock()
+	for _, block := range bc.Blocks {
+		if block.Id() == id {
+			return block, true
+		}
+	}
+	return Block{}, false
+}
+
 func (bc *BlockChain) PrintBlocks() {
 	bc.Lock.RLock()
 	fmt.Printf("%5s %-8s %-8s %-10s %s\n", "Index", "Hash", "PrevHash", "Timestamp", "Data")
@@ -94,10 +273,9 @@ func (bc *BlockChain) PrintBlocks() {
 
 func (bc *BlockChain) GetBlock(index int64) (Block, error) {
 	bc.Lock.RLock()
+	defer bc.Lock.RUnlock()
 	if index < 0 || index >= int64(len(bc.Blocks)) {
 		return Block{}, errors.New("Array Out of Bounds")
 	}
-	block := bc.Blocks[index]
-	bc.Lock.RUnlock()
-	return block, nil
+	return bc.Blocks[index], nil
 }
\ No newline at end of file
@@ -35,4 +35,92 @@ func TestBlockToStringAndFromString() error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+func TestReorganize() error {
+	bc := New(1, []byte{})
+	bc.AddBlockFromData(2, []byte{1})
+	genesis, _ := bc.GetBlock(0)
+
+	// a branch of the same length forking after the genesis block, only one of the two
+	// blockchains is preferred
+	other := NewFromBlock(genesis)
+	other.AddBlockFromData(3, []byte{2})
+	branch := other.BlocksAfter(bc.Locator(), 10)
+	if len(branch) != 1 || !bytes.Equal(branch[0].Data, []byte{2}) {
+		return errors.New("Expected the blocks after the common ancestor")
+	}
+	lastId, _ := bc.LastId()
+	otherLastId, _ := other.LastId()
+	orphaned, switched, err := bc.Reorganize(branch)
+	if err != nil {
+		return err
+	}
+	if switched != Prefer(2, otherLastId, 2, lastId) {
+		return errors.New("Expected fork choice to decide the reorganization")
+	}
+	if switched && (len(orphaned) != 1 || !bytes.Equal(orphaned[0].Data, []byte{1})) {
+		return errors.New("Expected the replaced block to be orphaned")
+	}
+
+	// a longer branch always wins
+	other.AddBlockFromData(4, []byte{3})
+	orphaned, switched, err = bc.Reorganize(other.BlocksAfter(bc.Locator(), 10))
+	if err != nil {
+		return err
+	}
+	if !switched || bc.NextIndex != 3 || !bc.HasData([]byte{3}) {
+		return errors.New("Expected the longest branch to win")
+	}
+
+	// blocks that don't fork from the blockchain are rejected
+	stray := New(5, []byte{9})
+	stray.AddBlockFromData(6, []byte{4})
+	block, _ := stray.GetBlock(1)
+	_, _, err = bc.Reorganize([]Block{block})
+	if err == nil {
+		return errors.New("Expected blocks of another blockchain to be rejected")
+	}
+
+	// blocks with negative or non consecutive indexes are rejected
+	block.Index = -1
+	_, _, err = bc.Reorganize([]Block{block})
+	if err == nil {
+		return errors.New("Expected a negative index to be rejected")
+	}
+	first, _ := bc.GetBlock(1)
+	second, _ := bc.GetBlock(2)
+	_, _, err = bc.Reorganize([]Block{second, first})
+	if err == nil {
+		return errors.New("Expected non consecutive indexes to be rejected")
+	}
+
+	// a longer blockchain with another genesis block is rejected
+	_, _, err = bc.Reorganize(stray.BlocksAfter(nil, 10))
+	if err == nil || bc.NextIndex != 3 {
+		return errors.New("Expected a branch replacing the genesis block to be rejected")
+	}
+	stray.AddBlockFromData(7, []byte{5})
+	stray.AddBlockFromData(8, []byte{6})
+	_, _, err = bc.Reorganize(stray.BlocksAfter(nil, 10))
+	if err == nil || bc.NextIndex != 3 {
+		return errors.New("Expected a branch replacing the genesis block to be rejected")
+	}
+
+	// the full blockchain of a peer starting with the same genesis block is accepted
+	full := bc.BlocksAfter(nil, 10)
+	extended, _ := NewFromBlocks(full)
+	extended.AddBlockFromData(9, []byte{7})
+	_, switched, err = bc.Reorganize(extended.BlocksAfter(nil, 10))
+	if err != nil || !switched || bc.NextIndex != 4 {
+		return errors.New("Expected a branch keeping the genesis block to be accepted")
+	}
+
+	// an empty blockchain takes any branch starting with a genesis block
+	empty := &BlockChain{}
+	_, switched, err = empty.Reorganize(stray.BlocksAfter(nil, 10))
+	if err != nil || !switched || empty.NextIndex != 4 {
+		return errors.New("Expected an empty blockchain to take the branch")
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+// Direct messages between nodes.
+//
+// Each node has an identity key, and sends its public key to its peers after the
+// handshake:
+//
+//     IDENTITY <public key>
+//
+// A direct message is signed with the identity key of the sender, and its text may be
+// encrypted to the identity key of the recipient:
+//
+//     DIRECT <id> <from> <to> <timestamp> <encrypted> <body> <public key> <signature>
+//
+// The message is sent on the connection to the recipient when there is one, otherwise
+// it is gossiped and relayed by the other nodes until it reaches the recipient.
+//
+// Nodes only pin the keys sent in IDENTITY by the peers they are connected to, never
+// the key carried by a direct message, which any node can forge. Messages from a peerId
+// with a pinned key must be signed with it, messages from other peerIds are delivered
+// marked as not verified. In a permissioned network the key of a peer was proven with
+// AUTH, see membership.go, but in an open network the peerId is only claimed in the
+// handshake, so the key of a peerId is the one of the first peer that connected with it
+// (trust on first use).
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/impadalko/CES27Projeto/network"
+	"github.com/impadalko/CES27Projeto/sign"
+	"github.com/impadalko/CES27Projeto/util"
+)
+
+// identity key of the node, generated on the first run
+const IdentityFilename = "identity_priv.pem"
+
+// maximum size of the body of a direct message
+const MaxDirectMessageSize = 4096
+
+type Identity struct {
+	PublicKey []byte
+}
+
+func (msg *Identity) Type() string               { return "IDENTITY" }
+func (msg *Identity) Encode(enc network.Encoder) { enc.Bytes(msg.PublicKey) }
+func (msg *Identity) Decode(dec network.Decoder) { msg.PublicKey = dec.Bytes() }
+
+type Direct struct {
+	Id        string // random id used to suppress duplicates
+	From      string
+	To        string
+	Timestamp int64
+	Encrypted bool
+	Body      []byte // text of the message, encrypted if Encrypted is set
+	PublicKey []byte // identity key of the sender
+	Signature []byte
+}
+
+func (msg *Direct) Type() string { return "DIRECT" }
+
+func (msg *Direct) Encode(enc network.Encoder) {
+	enc.String(msg.Id)
+	enc.String(msg.From)
+	enc.String(msg.To)
+	enc.Int(msg.Timestamp)
+	encrypted := int64(0)
+	if msg.Encrypted {
+		encrypted = 1
+	}
+	enc.Int(encrypted)
+	enc.Bytes(msg.Body)
+	enc.Bytes(msg.PublicKey)
+	enc.Bytes(msg.Signature)
+}
+
+func (msg *Direct) Decode(dec network.Decoder) {
+	msg.Id = dec.String()
+	msg.From = dec.String()
+	msg.To = dec.String()
+	msg.Timestamp = dec.Int()
+	msg.Encrypted = dec.Int() != 0
+	msg.Body = dec.Bytes()
+	msg.PublicKey = dec.Bytes()
+	msg.Signature = dec.Bytes()
+}
+
+// hash of the fields covered by the signature
+func (msg *Direct) Digest() []byte {
+	return sign.Hash([]byte(fmt.Sprintf("%s %s %s %d %t %x %x", msg.Id, msg.From, msg.To,
+		msg.Timestamp, msg.Encrypted, msg.Body, msg.PublicKey)))
+}
+
+func ValidateIdentity(msg network.Message) error {
+	_, err := sign.PublicKeyFromBytes(msg.(*Identity).PublicKey)
+	return err
+}
+
+func ValidateDirect(msg network.Message) error {
+	direct := msg.(*Direct)
+	if direct.Id == "" || direct.From == "" || direct.To == "" || len(direct.Signature) == 0 {
+		return errors.New("Invalid DIRECT fields")
+	}
+	if len(direct.Body) > MaxDirectMessageSize {
+		return errors.New("Direct message too large")
+	}
+	return nil
+}
+
+// a direct message received by the current node
+type InboxMessage struct {
+	From      string
+	Timestamp int64
+	Text      string
+	Encrypted bool
+	Verified  bool // whether the message was signed with the pinned key of the sender
+}
+
+// reads the identity key from @filename, generating it if the file does not exist
+func LoadIdentity(filename string) (*rsa.PrivateKey, error) {
+	privKey, err := sign.PrivateKeyFromPemFile(filename)
+	if !os.IsNotExist(err) {
+		return privKey, err
+	}
+	privKey, err = sign.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return privKey, sign.WritePrivateKeyToPemFile(privKey, filename)
+}
+
+// records @key as the identity key of @peerId, failing if another key was recorded before
+func (node *Node) PinKey(peerId string, key *rsa.PublicKey) error {
+	node.InboxLock.Lock()
+	defer node.InboxLock.Unlock()
+	if pinned, ok := node.PeerKeys[peerId]; ok {
+		if pinned.N.Cmp(key.N) != 0 || pinned.E != key.E {
+			return fmt.Errorf("The identity key of %s changed", peerId)
+		}
+		return nil
+	}
+	node.PeerKeys[peerId] = key
+	return nil
+}
+
+func (node *Node) PeerKey(peerId string) (*rsa.PublicKey, bool) {
+	node.InboxLock.Lock()
+	defer node.InboxLock.Unlock()
+	key, ok := node.PeerKeys[peerId]
+	return key, ok
+}
+
+func (node *Node) HandleIdentity(ctx *network.Context, msg network.Message) error {
+	// the peer sent its identity key
+	key, err := sign.PublicKeyFromBytes(msg.(*Identity).PublicKey)
+	if err != nil {
+		return err
+	}
+	if node.Permissioned() {
+		// the peer proved its key with AUTH before it could send IDENTITY
+		proven, ok := node.PeerIdentity(ctx.ConnInfo)
+		if !ok || keyString(proven) != keyString(key) {
+			ctx.Misbehave(network.ScoreMalformed, "IDENTITY differs from the proven key")
+			return errors.New("The IDENTITY of the peer differs from its proven key")
+		}
+	}
+	peerId, _ := ctx.ConnInfo.GetPeer()
+	return node.PinKey(peerId, key)
+}
+
+// sends @text to the node @peerId, encrypted to its identity key if @encrypt is set
+func (node *Node) SendDirect(peerId string, text string, encrypt bool) error {
+	if node.Identity == nil {
+		return errors.New("The node has no identity key")
+	}
+	body := []byte(text)
+	if encrypt {
+		key, ok := node.PeerKey(peerId)
+		if !ok {
+			return fmt.Errorf("The identity key of %s is unknown", peerId)
+		}
+		var err error
+		body, err = sign.Encrypt(key, body)
+		if err != nil {
+			return err
+		}
+	}
+	if len(body) > MaxDirectMessageSize {
+		return errors.New("Direct message too large")
+	}
+	msg := &Direct{
+		Id:        util.RandomString(16),
+		From:      node.Network.NodeId,
+		To:        peerId,
+		Timestamp: util.Now(),
+		Encrypted: encrypt,
+		Body:      body,
+		PublicKey: sign.PublicKeyToBytes(&node.Identity.PublicKey),
+	}
+	signature, err := sign.Sign(node.Identity, msg.Digest())
+	if err != nil {
+		return err
+	}
+	msg.Signature = signature
+	node.DirectSeen.Add(msg.Id)
+
+	if connInfo, ok := node.Network.GetPeerConn(peerId); ok && connInfo.Supports(msg.Type()) {
+		return connInfo.SendMessage(msg)
+	}
+	// the message is relayed by the other nodes
+	node.Network.Gossip(msg)
+	return nil
+}
+
+func (node *Node) HandleDirect(ctx *network.Context, msg network.Message) error {
+	// a node sent a direct message, to the current node or to be relayed
+	direct := msg.(*Direct)
+	key, err := sign.PublicKeyFromBytes(direct.PublicKey)
+	if err != nil {
+		return err
+	}
+	err = sign.Verify(key, direct.Digest(), direct.Signature)
+	if err != nil {
+		ctx.Misbehave(network.ScoreMalformed, "invalid signature of direct message")
+		return errors.New("Invalid signature of direct message")
+	}
+	if direct.To != node.Network.NodeId || !node.DirectSeen.Add(direct.Id) {
+		return nil
+	}
+	pinned, verified := node.PeerKey(direct.From)
+	if verified && keyString(pinned) != keyString(key) {
+		return fmt.Errorf("The direct message is not signed with the identity key of %s", direct.From)
+	}
+
+	text := direct.Body
+	if direct.Encrypted && node.Identity == nil {
+		return errors.New("The node has no identity key")
+	} else if direct.Encrypted {
+		text, err = sign.Decrypt(node.Identity, direct.Body)
+		if err != nil {
+			return err
+		}
+	}
+	node.InboxLock.Lock()
+	node.Inbox = append(node.Inbox, InboxMessage{direct.From, direct.Timestamp, string(text), direct.Encrypted, verified})
+	node.InboxLock.Unlock()
+	if !verified {
+		fmt.Printf("Message from %s (not verified): %s\n\n", direct.From, text)
+		return nil
+	}
+	fmt.Printf("Message from %s: %s\n\n", direct.From, text)
+	return nil
+}
+
+func (node *Node) PrintInbox() {
+	node.InboxLock.Lock()
+	defer node.InboxLock.Unlock()
+	if len(node.Inbox) == 0 {
+		fmt.Println("No Messages")
+		fmt.Println()
+		return
+	}
+	fmt.Printf("%-19s %-10s %-9s %-8s %s\n", "Time", "From", "Encrypted", "Verified", "Text")
+	for _, msg := range node.Inbox {
+		timestamp := time.Unix(msg.Timestamp, 0).Format("2006-01-02 15:04:05")
+		fmt.Printf("%-19s %-10s %-9t %-8t %s\n", timestamp, msg.From, msg.Encrypted, msg.Verified, msg.Text)
+	}
+	fmt.Println()
+}
@@ -3,11 +3,15 @@ package main
 import (
 	"bufio"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 	"io/ioutil"
 
 	"github.com/impadalko/CES27Projeto/blockchain"
@@ -16,11 +20,41 @@ import (
 	"github.com/impadalko/CES27Projeto/util"
 )
 
+// optional configuration file of the node, see network/config.go
+const ConfigFilename = "config.json"
+
 func main() {
 	//Tests()
 
+	config, err := network.LoadConfig(ConfigFilename)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	node := NewNode(util.RandomString(8))
-	err := node.Listen()
+	node.Network.SetConfig(config)
+	node.Network.AddrBook, err = network.LoadAddrBook(config.AddrBookFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	node.Network.BanList, err = network.LoadBanList(config.BanListFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	node.Identity, err = LoadIdentity(IdentityFilename)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	node.AdminKey, err = sign.PublicKeyFromPemFile(AdminKeyFilename)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = node.Listen()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -28,24 +62,42 @@ func main() {
 	node.PrintInfo()
 	
 	if len(os.Args) == 2 {
-		// connect to another peer and join its network
+		// connect to another peer and join its network, the blockchain of the
+		// peer is requested after the handshake
 		peerAddr := os.Args[1]
 		conn, err := node.JoinNetwork(peerAddr)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-		// request copy of the blockchain of the peer
-		fmt.Fprintf(conn, "REQUEST-BLOCKCHAIN\n")
 		go node.StartHandleConnection(conn)
-	} else {
-		// start own blockchain and network
-		node.BlockChain = blockchain.New(util.Now(), []byte{})
+	} else if len(config.Seeds) == 0 && len(node.Network.AddrBook.Candidates()) == 0 && !config.Observer {
+		// start own blockchain and network, observers only follow the blockchain of
+		// their peers
+		node.BlockChain.Replace(blockchain.New(util.Now(), []byte{}))
 		node.PrintBlocks()
 	}
 
 	go node.Start()
 
+	// keep connected to the seeds and the peers of the address book
+	go node.Network.StartConnectionManager()
+
+	// announce known addresses to the peers
+	go node.Network.StartAddrGossip()
+
+	// detect and evict dead peers
+	go node.Network.StartHeartbeat()
+
+	// leave the network when the process is interrupted or terminated
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		node.Leave()
+		os.Exit(0)
+	}()
+
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		text, err := reader.ReadString('\n')
@@ -64,15 +116,21 @@ func main() {
 
 		command := split[0]
 
-		err = HandleCommand(command, split)
+		if command == "leave" {
+			// Leave the network and exit
+			break
+		}
+
+		err = node.HandleCommand(command, split)
 		if err != nil {
 			fmt.Println(err)
 			fmt.Println()
 		}
 	}
+	node.Leave()
 }
 
-func HandleCommand(command string, split []string) error {
+func (node *Node) HandleCommand(command string, split []string) error {
 	
 	if command == "info" {
 		// Display node id and node address
@@ -89,6 +147,20 @@ func HandleCommand(command string, split []string) error {
 
 		node.PrintConns()
 
+	} else if command == "netstats" && (len(split) == 1 || len(split) == 2 && split[1] == "json") {
+		// Display the traffic statistics of each connection, as a table or as JSON
+
+		if len(split) == 2 {
+			data, err := json.MarshalIndent(node.Network.Stats(), "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+			fmt.Println()
+		} else {
+			node.PrintNetStats()
+		}
+
 	} else if command == "blocks" {
 		// Display the list of blocks of the blockchain
 
@@ -101,12 +173,19 @@ func HandleCommand(command string, split []string) error {
 		if err != nil {
 			return err
 		}
-		node.AddBlockFromData(util.Now(), data)
+		_, err = node.AddBlockFromData(util.Now(), data)
+		if err != nil {
+			return err
+		}
 		node.PrintBlocks()
 
 	} else if len(split) == 2 && command == "cast" {
-		// Broadcast a block to all the peers
+		// Push a block to all the peers, even to the ones that already have it.
+		// New blocks are announced automatically, this is kept for debugging
 
+		if node.Network.IsObserver() {
+			return network.ErrObserver
+		}
 		blockIndex, err := strconv.ParseInt(split[1], 10, 64)
 		if err != nil {
 			return err
@@ -115,8 +194,129 @@ func HandleCommand(command string, split []string) error {
 		if err != nil {
 			return err
 		}
-		message := fmt.Sprintf("BLOCK-ADD %s\n", block.String())
-		node.Broadcast(message)
+		node.Broadcast(&BlockAdd{block})
+
+	} else if (len(split) == 2 || len(split) == 3) && command == "ban" {
+		// Ban a peer by its peerId or IP, for the supplied duration or the configured one
+
+		duration := time.Duration(node.Network.Config.BanDuration)
+		if len(split) == 3 {
+			var err error
+			duration, err = time.ParseDuration(split[2])
+			if err != nil {
+				return err
+			}
+		}
+		err := node.Network.Ban(split[1], duration, "banned manually")
+		if err != nil {
+			return err
+		}
+		node.PrintBanList()
+
+	} else if len(split) == 2 && command == "unban" {
+		// Remove the ban of a peerId or IP
+
+		err := node.Network.BanList.Unban(split[1])
+		if err != nil {
+			return err
+		}
+		node.PrintBanList()
+
+	} else if command == "banlist" {
+		// Display the banned peerIds and IPs
+
+		node.PrintBanList()
+
+	} else if len(split) == 2 && command == "subscribe" {
+		// Receive the messages published on a topic
+
+		err := node.Subscribe(split[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println("Subscribed to", split[1])
+		fmt.Println()
+
+	} else if len(split) == 2 && command == "unsubscribe" {
+		// Stop receiving the messages published on a topic
+
+		err := node.Unsubscribe(split[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println("Unsubscribed from", split[1])
+		fmt.Println()
+
+	} else if len(split) >= 3 && command == "publish" {
+		// Publish a text message on a topic to the nodes subscribed to it
+
+		err := node.Network.Publish(split[1], []byte(strings.Join(split[2:], " ")))
+		if err != nil {
+			return err
+		}
+
+	} else if len(split) >= 3 && command == "msg" {
+		// Send a signed text message to a node, encrypted to its identity key with -e
+
+		encrypt := split[1] == "-e"
+		if encrypt {
+			split = split[1:]
+		}
+		if len(split) < 3 {
+			return errors.New("Invalid Command")
+		}
+		err := node.SendDirect(split[1], strings.Join(split[2:], " "), encrypt)
+		if err != nil {
+			return err
+		}
+
+	} else if command == "inbox" {
+		// Display the direct messages received
+
+		node.PrintInbox()
+
+	} else if (len(split) == 1 || len(split) == 2) && command == "identity" {
+		// Display the identity key of the node, or write it to a PEM file. The
+		// identity key of the admin node is the admin key of a permissioned network
+
+		if len(split) == 2 {
+			err := sign.WritePublicKeyToPemFile(&node.Identity.PublicKey, split[1])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Identity key written to %s\n\n", split[1])
+		} else {
+			fmt.Println("Fingerprint:", Fingerprint(&node.Identity.PublicKey))
+			fmt.Println(hex.EncodeToString(sign.PublicKeyToBytes(&node.Identity.PublicKey)))
+			fmt.Println()
+		}
+
+	} else if len(split) == 3 && command == "member" && (split[1] == "add" || split[1] == "remove") {
+		// Add or remove a member of a permissioned network by its identity key, only
+		// allowed to the admin
+
+		keyBytes, err := hex.DecodeString(split[2])
+		if err != nil {
+			return err
+		}
+		key, err := sign.PublicKeyFromBytes(keyBytes)
+		if err != nil {
+			return err
+		}
+		action := AddMember
+		if split[1] == "remove" {
+			action = RemoveMember
+		}
+		blockIndex, err := node.AddMemberRecord(action, key)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %s recorded in block %d\n\n", action, Fingerprint(key), blockIndex)
+
+	} else if command == "members" {
+		// Display the members of a permissioned network
+
+		node.PrintMembers()
 
 	} else if len(split) == 2 && command == "genkey" {
 		// generate a private/public key pair
@@ -250,6 +450,12 @@ func Tests() {
 		os.Exit(1)
 	}
 
+	err = blockchain.TestReorganize()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	err = sign.TestWriteAndReadPemFile()
 	if err != nil {
 		fmt.Println(err)
@@ -262,11 +468,167 @@ func Tests() {
 		os.Exit(1)
 	}
 	
+	err = sign.TestEncryptAndDecrypt()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	err = network.TestNodeJoinNetwork()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
+	err = network.TestHelloCompatibility()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestTextAndBinaryFraming()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestMessageRegistry()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestMiddlewares()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestCallAndReply()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestGossipReachesAllNodes()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestAddrBookBackoff()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestHeartbeats()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestLeave()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestSendQueue()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestMisbehaviourBan()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestResourceLimits()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestSimultaneousDial()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestTransports()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestAddrGossip()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestConnStats()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestPubSub()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestCompression()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestObserver()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = network.TestInventory()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = TestSimulatorConvergence()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = TestDirectMessages()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = TestObserverNode()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = TestBlockRelay()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = TestMembership()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	fmt.Println("ALL TESTS PASSED")
 }
\ No newline at end of file
@@ -0,0 +1,459 @@
+package main
+
+// Permissioned network membership.
+//
+// A node that has the public key of the admin, in AdminKeyFilename, only talks to the
+// members of the network. Members are identified by their identity key (see direct.go)
+// and are added and removed with records signed by the admin key, stored as the data
+// of blocks of the blockchain:
+//
+//     ADD-MEMBER <id> <public key> <signature>
+//     REMOVE-MEMBER <id> <public key> <signature>
+//
+// Records are applied in the order of the blockchain, and a record whose id was already
+// seen is ignored, so old records can't be replayed. The node whose identity key is the
+// admin key is always a member.
+//
+// After the handshake each side challenges the other to prove that it has its identity
+// key, signing a random nonce along with the peerIds of both sides:
+//
+//     AUTH-CHALLENGE <nonce>
+//     AUTH <public key> <signature>
+//
+// The peerIds are claimed by the peers themselves, so the node that dialed the
+// connection answers first, and the node that accepted it only answers once the dialer
+// is verified to be a member. Otherwise a non member could dial two members claiming to
+// be the other one, and relay the answer of each member to the challenge of the other.
+//
+// Until a peer is verified to be a member only the handshake, heartbeat and
+// authentication messages are accepted from it, and it does not learn the peers,
+// addresses or subscriptions of the current node. A node without a blockchain can't
+// check the members, so it only verifies the admin node and syncs from it, the other
+// peers are verified once the blockchain is synced. Peers that are not members, or
+// that are not verified within Config.CallTimeout, are disconnected. Whenever the
+// blockchain changes the peers that are not members anymore are disconnected.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/impadalko/CES27Projeto/network"
+	"github.com/impadalko/CES27Projeto/sign"
+	"github.com/impadalko/CES27Projeto/util"
+)
+
+// public key of the admin of a permissioned network
+const AdminKeyFilename = "admin_pub.pem"
+
+const (
+	AddMember    = "ADD-MEMBER"
+	RemoveMember = "REMOVE-MEMBER"
+)
+
+// messages accepted from a peer before it is verified
+var preAuthMessages = []string{"PING", "PONG", "LEAVE", "AUTH-CHALLENGE", "AUTH"}
+
+type MemberRecord struct {
+	Action    string // AddMember or RemoveMember
+	Id        string // random id used to reject replayed records
+	PublicKey []byte // identity key of the member
+	Signature []byte // signature of the admin
+}
+
+func (record *MemberRecord) Type() string { return record.Action }
+
+func (record *MemberRecord) Encode(enc network.Encoder) {
+	enc.String(record.Id)
+	enc.Bytes(record.PublicKey)
+	enc.Bytes(record.Signature)
+}
+
+func (record *MemberRecord) Decode(dec network.Decoder) {
+	record.Id = dec.String()
+	record.PublicKey = dec.Bytes()
+	record.Signature = dec.Bytes()
+}
+
+// hash of the fields covered by the signature
+func (record *MemberRecord) Digest() []byte {
+	return sign.Hash([]byte(fmt.Sprintf("%s %s %x", record.Action, record.Id, record.PublicKey)))
+}
+
+// data of a block holding the record
+func (record *MemberRecord) Bytes() []byte {
+	return network.EncodeText(record)
+}
+
+// decodes the record stored in the data of a block, if there is one
+func MemberRecordFromBytes(data []byte) (*MemberRecord, bool) {
+	if !bytes.HasPrefix(data, []byte(AddMember+" ")) && !bytes.HasPrefix(data, []byte(RemoveMember+" ")) {
+		return nil, false
+	}
+	msg, err := network.ReadMessage(bufio.NewReader(bytes.NewReader(data)), func(messageType string) network.Message {
+		return &MemberRecord{Action: messageType}
+	})
+	if err != nil {
+		return nil, false
+	}
+	return msg.(*MemberRecord), true
+}
+
+type AuthChallenge struct {
+	Nonce string
+}
+
+func (msg *AuthChallenge) Type() string               { return "AUTH-CHALLENGE" }
+func (msg *AuthChallenge) Encode(enc network.Encoder) { enc.String(msg.Nonce) }
+func (msg *AuthChallenge) Decode(dec network.Decoder) { msg.Nonce = dec.String() }
+
+type Auth struct {
+	PublicKey []byte // identity key of the peer
+	Signature []byte // signature of AuthDigest
+}
+
+func (msg *Auth) Type() string { return "AUTH" }
+
+func (msg *Auth) Encode(enc network.Encoder) {
+	enc.Bytes(msg.PublicKey)
+	enc.Bytes(msg.Signature)
+}
+
+func (msg *Auth) Decode(dec network.Decoder) {
+	msg.PublicKey = dec.Bytes()
+	msg.Signature = dec.Bytes()
+}
+
+// hash signed by the node @from to answer the challenge @nonce of the node @to
+func AuthDigest(nonce string, from string, to string) []byte {
+	return sign.Hash([]byte(fmt.Sprintf("AUTH %s %s %s", nonce, from, to)))
+}
+
+func ValidateAuthChallenge(msg network.Message) error {
+	if len(msg.(*AuthChallenge).Nonce) < 16 {
+		return errors.New("Nonce too short")
+	}
+	return nil
+}
+
+func ValidateAuth(msg network.Message) error {
+	if len(msg.(*Auth).Signature) == 0 {
+		return errors.New("Invalid AUTH fields")
+	}
+	_, err := sign.PublicKeyFromBytes(msg.(*Auth).PublicKey)
+	return err
+}
+
+// authentication of the peer of a connection
+type peerAuth struct {
+	nonce     string
+	challenge string         // nonce of the peer, answered once the peer is verified
+	key       *rsa.PublicKey // nil until the peer answers the challenge
+	verified  bool           // the peer is a member and was greeted
+}
+
+// hex encoding of a public key, used to compare keys
+func keyString(key *rsa.PublicKey) string {
+	return hex.EncodeToString(sign.PublicKeyToBytes(key))
+}
+
+// short fingerprint of a public key, for display
+func Fingerprint(key *rsa.PublicKey) string {
+	return hex.EncodeToString(sign.Hash(sign.PublicKeyToBytes(key)))[:16]
+}
+
+// whether only the members of the network may connect to the current node
+func (node *Node) Permissioned() bool {
+	return node.AdminKey != nil
+}
+
+// the identity keys of the members, by keyString, applying the valid records of the
+// blockchain in order
+func (node *Node) Members() map[string]*rsa.PublicKey {
+	members := map[string]*rsa.PublicKey{}
+	if node.AdminKey == nil {
+		return members
+	}
+	members[keyString(node.AdminKey)] = node.AdminKey
+	seen := map[string]bool{}
+	node.BlockChain.Lock.RLock()
+	defer node.BlockChain.Lock.RUnlock()
+	for _, block := range node.BlockChain.Blocks {
+		record, ok := MemberRecordFromBytes(block.Data)
+		if !ok || seen[record.Id] || sign.Verify(node.AdminKey, record.Digest(), record.Signature) != nil {
+			continue
+		}
+		seen[record.Id] = true
+		key, err := sign.PublicKeyFromBytes(record.PublicKey)
+		if err != nil {
+			continue
+		}
+		if record.Action == AddMember {
+			members[keyString(key)] = key
+		} else if keyString(key) != keyString(node.AdminKey) {
+			delete(members, keyString(key))
+		}
+	}
+	return members
+}
+
+// whether the node with the identity key @key may connect to the current node. Only
+// the admin is known to be a member before the blockchain is synced
+func (node *Node) IsMember(key *rsa.PublicKey) bool {
+	if !node.Permissioned() {
+		return true
+	}
+	if _, ok := node.BlockChain.ChainId(); !ok {
+		return keyString(key) == keyString(node.AdminKey)
+	}
+	_, ok := node.Members()[keyString(key)]
+	return ok
+}
+
+// adds a record signed with the identity key of the current node, which must be the
+// admin key, to the blockchain. Returns the index of its block
+func (node *Node) AddMemberRecord(action string, key *rsa.PublicKey) (int64, error) {
+	if !node.Permissioned() || node.Identity == nil || keyString(&node.Identity.PublicKey) != keyString(node.AdminKey) {
+		return 0, errors.New("Only the admin can change the members")
+	}
+	record := &MemberRecord{
+		Action:    action,
+		Id:        util.RandomString(16),
+		PublicKey: sign.PublicKeyToBytes(key),
+	}
+	signature, err := sign.Sign(node.Identity, record.Digest())
+	if err != nil {
+		return 0, err
+	}
+	record.Signature = signature
+	return node.AddBlockFromData(util.Now(), record.Bytes())
+}
+
+// challenges a new peer to prove its identity key, it is disconnected if it is not
+// verified in time
+func (node *Node) Challenge(connInfo *network.ConnInfo) {
+	if !connInfo.Supports("AUTH-CHALLENGE") {
+		peerId, _ := connInfo.GetPeer()
+		fmt.Printf("Disconnecting %s: authentication not supported\n\n", peerId)
+		connInfo.Close()
+		return
+	}
+	nonce := util.RandomString(32)
+	node.AuthLock.Lock()
+	// forget the connections that were closed
+	for other := range node.Auth {
+		if _, ok := node.Network.GetConn(other.Conn); !ok {
+			delete(node.Auth, other)
+		}
+	}
+	node.Auth[connInfo] = &peerAuth{nonce: nonce}
+	node.AuthLock.Unlock()
+	connInfo.SendMessage(&AuthChallenge{nonce})
+
+	time.AfterFunc(time.Duration(node.Network.Config.CallTimeout), func() {
+		if _, ok := node.PeerIdentity(connInfo); !ok {
+			peerId, _ := connInfo.GetPeer()
+			fmt.Printf("Disconnecting %s: membership not verified in time\n\n", peerId)
+			connInfo.Close()
+		}
+	})
+}
+
+// the identity key proved by the peer of the connection, once it is verified to be a
+// member
+func (node *Node) PeerIdentity(connInfo *network.ConnInfo) (*rsa.PublicKey, bool) {
+	node.AuthLock.Lock()
+	defer node.AuthLock.Unlock()
+	auth, ok := node.Auth[connInfo]
+	if !ok || !auth.verified {
+		return nil, false
+	}
+	return auth.key, true
+}
+
+func (node *Node) HandleAuthChallenge(ctx *network.Context, msg network.Message) error {
+	// the peer asked the current node to prove its identity key
+	if node.Identity == nil {
+		return errors.New("The node has no identity key")
+	}
+	nonce := msg.(*AuthChallenge).Nonce
+	if !node.Permissioned() || ctx.ConnInfo.Outbound {
+		return node.AnswerChallenge(ctx.ConnInfo, nonce)
+	}
+	// the peer dialed the current node, it must be verified before it gets an answer
+	node.AuthLock.Lock()
+	pending, ok := node.Auth[ctx.ConnInfo]
+	if ok && !pending.verified {
+		pending.challenge = nonce
+	}
+	node.AuthLock.Unlock()
+	if !ok {
+		ctx.Misbehave(network.ScoreSpam, "unexpected AUTH-CHALLENGE")
+		return errors.New("Unexpected AUTH-CHALLENGE")
+	}
+	if pending.verified {
+		return node.AnswerChallenge(ctx.ConnInfo, nonce)
+	}
+	return nil
+}
+
+// signs the challenge @nonce of the peer of the connection with the identity key
+func (node *Node) AnswerChallenge(connInfo *network.ConnInfo, nonce string) error {
+	peerId, _ := connInfo.GetPeer()
+	signature, err := sign.Sign(node.Identity, AuthDigest(nonce, node.Network.NodeId, peerId))
+	if err != nil {
+		return err
+	}
+	return connInfo.SendMessage(&Auth{sign.PublicKeyToBytes(&node.Identity.PublicKey), signature})
+}
+
+// marks the peer of the connection as verified, answers its challenge if it is waiting
+// for it and greets it
+func (node *Node) verify(connInfo *network.ConnInfo) {
+	node.AuthLock.Lock()
+	pending, ok := node.Auth[connInfo]
+	if !ok || pending.verified {
+		node.AuthLock.Unlock()
+		return
+	}
+	pending.verified = true
+	challenge := pending.challenge
+	pending.challenge = ""
+	node.AuthLock.Unlock()
+	if challenge != "" {
+		err := node.AnswerChallenge(connInfo, challenge)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	node.Greet(connInfo)
+}
+
+func (node *Node) HandleAuth(ctx *network.Context, msg network.Message) error {
+	// the peer answered the challenge of the current node
+	auth := msg.(*Auth)
+	node.AuthLock.Lock()
+	pending, ok := node.Auth[ctx.ConnInfo]
+	node.AuthLock.Unlock()
+	if !ok || pending.key != nil {
+		ctx.Misbehave(network.ScoreSpam, "unexpected AUTH")
+		return errors.New("Unexpected AUTH")
+	}
+
+	key, err := sign.PublicKeyFromBytes(auth.PublicKey)
+	if err != nil {
+		return err
+	}
+	peerId, _ := ctx.ConnInfo.GetPeer()
+	err = sign.Verify(key, AuthDigest(pending.nonce, peerId, node.Network.NodeId), auth.Signature)
+	if err != nil {
+		ctx.Misbehave(network.ScoreMalformed, "invalid AUTH signature")
+		ctx.Disconnect("invalid AUTH signature")
+		return errors.New("Invalid AUTH signature")
+	}
+	_, synced := node.BlockChain.ChainId()
+	member := node.IsMember(key)
+	if !member && synced {
+		ctx.Disconnect("not a member")
+		return nil
+	}
+	node.AuthLock.Lock()
+	pending.key = key
+	node.AuthLock.Unlock()
+	if member {
+		node.verify(ctx.ConnInfo)
+	}
+	// otherwise the peer is verified by CheckMembers once the blockchain is synced
+	return nil
+}
+
+// drops the messages of peers that did not authenticate yet, other than the ones needed
+// to authenticate
+func (node *Node) AuthMiddleware(next network.Handler) network.Handler {
+	return func(ctx *network.Context, msg network.Message) error {
+		if !node.Permissioned() || ctx.ConnInfo.GetHello() == nil {
+			return next(ctx, msg)
+		}
+		if _, ok := node.PeerIdentity(ctx.ConnInfo); ok {
+			return next(ctx, msg)
+		}
+		for _, messageType := range preAuthMessages {
+			if messageType == msg.Type() {
+				return next(ctx, msg)
+			}
+		}
+		return fmt.Errorf("The message type %s was sent before authentication", msg.Type())
+	}
+}
+
+// disconnects the peers that are not members anymore and greets the peers waiting for
+// the blockchain to be synced, called whenever the blockchain changes
+func (node *Node) CheckMembers() {
+	if !node.Permissioned() {
+		return
+	}
+	if _, ok := node.BlockChain.ChainId(); !ok {
+		return
+	}
+	members := node.Members()
+	node.AuthLock.Lock()
+	removed, verified := []*network.ConnInfo{}, []*network.ConnInfo{}
+	for connInfo, auth := range node.Auth {
+		if auth.key == nil {
+			continue
+		}
+		if _, ok := members[keyString(auth.key)]; !ok {
+			removed = append(removed, connInfo)
+			delete(node.Auth, connInfo)
+		} else if !auth.verified {
+			verified = append(verified, connInfo)
+		}
+	}
+	node.AuthLock.Unlock()
+	for _, connInfo := range removed {
+		peerId, _ := connInfo.GetPeer()
+		fmt.Printf("Disconnecting %s: not a member\n\n", peerId)
+		connInfo.Close()
+	}
+	for _, connInfo := range verified {
+		node.verify(connInfo)
+	}
+}
+
+// whether the peer may learn the peers, addresses and subscriptions of the current node
+func (node *Node) Authorized(connInfo *network.ConnInfo) bool {
+	if !node.Permissioned() {
+		return true
+	}
+	_, ok := node.PeerIdentity(connInfo)
+	return ok
+}
+
+func (node *Node) PrintMembers() {
+	if !node.Permissioned() {
+		fmt.Println("The network is not permissioned")
+		fmt.Println()
+		return
+	}
+	connected := map[string]string{}
+	node.AuthLock.Lock()
+	for connInfo, auth := range node.Auth {
+		if auth.verified {
+			connected[keyString(auth.key)], _ = connInfo.GetPeer()
+		}
+	}
+	node.AuthLock.Unlock()
+	fmt.Printf("%-16s %s\n", "Fingerprint", "PeerId")
+	for member, key := range node.Members() {
+		peerId, ok := connected[member]
+		if !ok {
+			peerId = "-"
+		}
+		fmt.Printf("%-16s %s\n", Fingerprint(key), peerId)
+	}
+	fmt.Println()
+}
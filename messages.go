@@ -0,0 +1,146 @@
+package main
+
+// Messages exchanged between nodes about the blockchain
+
+import (
+	"errors"
+
+	"github.com/impadalko/CES27Projeto/blockchain"
+	"github.com/impadalko/CES27Projeto/network"
+)
+
+type BlockAdd struct {
+	Block blockchain.Block
+}
+
+func (msg *BlockAdd) Type() string { return "BLOCK-ADD" }
+
+func (msg *BlockAdd) Encode(enc network.Encoder) {
+	enc.Bytes(msg.Block.Bytes())
+}
+
+func (msg *BlockAdd) Decode(dec network.Decoder) {
+	block, err := blockchain.BlockFromBytes(dec.Bytes())
+	if err != nil {
+		dec.Fail(err)
+	}
+	msg.Block = block
+}
+
+type RequestBlockchain struct{}
+
+func (msg *RequestBlockchain) Type() string               { return "REQUEST-BLOCKCHAIN" }
+func (msg *RequestBlockchain) Encode(enc network.Encoder) {}
+func (msg *RequestBlockchain) Decode(dec network.Decoder) {}
+
+func ValidateBlockAdd(msg network.Message) error {
+	block := msg.(*BlockAdd).Block
+	if block.Index < 0 || int(block.DataLen) != len(block.Data) {
+		return errors.New("Malformed block")
+	}
+	return nil
+}
+
+// a batch of consecutive blocks, sent as the reply of a REQUEST-BLOCKCHAIN call
+type Blocks struct {
+	Blocks []blockchain.Block
+}
+
+func (msg *Blocks) Type() string { return "BLOCKS" }
+
+func (msg *Blocks) Encode(enc network.Encoder) {
+	enc.Int(int64(len(msg.Blocks)))
+	for _, block := range msg.Blocks {
+		enc.Bytes(block.Bytes())
+	}
+}
+
+func (msg *Blocks) Decode(dec network.Decoder) {
+	n := dec.Int()
+	msg.Blocks = []blockchain.Block{}
+	for i := int64(0); i < n && dec.Err() == nil; i++ {
+		block, err := blockchain.BlockFromBytes(dec.Bytes())
+		if err != nil {
+			dec.Fail(err)
+		}
+		msg.Blocks = append(msg.Blocks, block)
+	}
+}
+
+func ValidateBlocks(msg network.Message) error {
+	for _, block := range msg.(*Blocks).Blocks {
+		err := ValidateBlockAdd(&BlockAdd{block})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the last block of the blockchain of a node, sent after the handshake so the peers can
+// compare their blockchains
+type Tip struct {
+	NextIndex int64
+	LastId    []byte // empty if the blockchain is empty
+}
+
+func (msg *Tip) Type() string { return "TIP" }
+
+func (msg *Tip) Encode(enc network.Encoder) {
+	enc.Int(msg.NextIndex)
+	enc.Bytes(msg.LastId)
+}
+
+func (msg *Tip) Decode(dec network.Decoder) {
+	msg.NextIndex = dec.Int()
+	msg.LastId = dec.Bytes()
+}
+
+func ValidateTip(msg network.Message) error {
+	tip := msg.(*Tip)
+	if tip.NextIndex < 0 || len(tip.LastId) != 0 && len(tip.LastId) != len(blockchain.HashVal{}) {
+		return errors.New("Malformed tip")
+	}
+	return nil
+}
+
+// maximum number of blocks of a reply to GET-BLOCKS
+const MaxBlocksPerReply = 500
+
+// maximum number of GET-BLOCKS requests made to sync with a single peer
+const MaxSyncRequests = 1000
+
+// requests the blocks that follow the last block of the locator the peer has, see
+// BlockChain.Locator. Sent as a call, the reply is a BLOCKS message
+type GetBlocks struct {
+	Locator []blockchain.HashVal
+}
+
+func (msg *GetBlocks) Type() string { return "GET-BLOCKS" }
+
+func (msg *GetBlocks) Encode(enc network.Encoder) {
+	locator := []string{}
+	for _, id := range msg.Locator {
+		locator = append(locator, id.String())
+	}
+	enc.Strings(locator)
+}
+
+func (msg *GetBlocks) Decode(dec network.Decoder) {
+	msg.Locator = []blockchain.HashVal{}
+	for _, str := range dec.Strings() {
+		id, err := blockchain.HashValFromString(str)
+		if err != nil {
+			dec.Fail(err)
+			return
+		}
+		msg.Locator = append(msg.Locator, id)
+	}
+}
+
+func ValidateGetBlocks(msg network.Message) error {
+	if len(msg.(*GetBlocks).Locator) > 100 {
+		return errors.New("Locator too long")
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package network
+
+// Periodic address gossip.
+//
+// Besides the PEER-LIST sent when joining, every Config.AddrInterval each node sends to
+// its peers an ADDR message with a sample of the addresses it knows, each one with the
+// time its peer was last seen:
+//
+//     ADDR <count> <peerId> <addr> <timestamp> ...
+//
+// The sample includes the current node, its peers and the addresses of the address book
+// seen in the last Config.AddrMaxAge, at most MaxAddrEntries of them. Received addresses
+// are merged into the address book only when they are fresher than what the node already
+// knows, and the connection manager dials them, so peers that join later are eventually
+// known by every node.
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/impadalko/CES27Projeto/util"
+)
+
+// maximum number of addresses in a single ADDR message
+const MaxAddrEntries = 100
+
+// timestamps up to this far in the future are accepted, to tolerate clock differences
+const MaxAddrClockSkew = 10 * 60 // seconds
+
+type AddrInfo struct {
+	PeerId    string
+	Addr      string
+	Timestamp int64 // seconds since 01/01/1970 UTC when the peer was last seen
+}
+
+type Addr struct {
+	Entries []AddrInfo
+}
+
+func (msg *Addr) Type() string { return "ADDR" }
+
+func (msg *Addr) Encode(enc Encoder) {
+	enc.Int(int64(len(msg.Entries)))
+	for _, entry := range msg.Entries {
+		enc.String(entry.PeerId)
+		enc.String(entry.Addr)
+		enc.Int(entry.Timestamp)
+	}
+}
+
+func (msg *Addr) Decode(dec Decoder) {
+	count := dec.Int()
+	if count < 0 || count > MaxAddrEntries {
+		dec.Fail(errors.New("Invalid number of addresses"))
+		return
+	}
+	msg.Entries = make([]AddrInfo, count)
+	for i := range msg.Entries {
+		msg.Entries[i].PeerId = dec.String()
+		msg.Entries[i].Addr = dec.String()
+		msg.Entries[i].Timestamp = dec.Int()
+	}
+}
+
+func ValidateAddr(msg Message) error {
+	entries := msg.(*Addr).Entries
+	if len(entries) == 0 || len(entries) > MaxAddrEntries {
+		return errors.New("Invalid number of addresses")
+	}
+	for _, entry := range entries {
+		err := validatePeer(entry.PeerId, entry.Addr)
+		if err != nil {
+			return err
+		}
+		if entry.Timestamp <= 0 {
+			return errors.New("Invalid address timestamp")
+		}
+	}
+	return nil
+}
+
+func HandleAddr(ctx *Context, msg Message) error {
+	// the other peer sent addresses it knows, they are dialed by the connection manager
+	network := ctx.Network
+	maxAge := int64(time.Duration(network.Config.AddrMaxAge) / time.Second)
+	source, _ := ctx.ConnInfo.GetPeer()
+	for _, entry := range msg.(*Addr).Entries {
+		if entry.PeerId == network.NodeId || entry.Addr == network.NodeAddr {
+			continue
+		}
+		if network.IsBanned(entry.PeerId, entry.Addr) {
+			continue
+		}
+		network.AddrBook.Merge(entry, maxAge, source)
+	}
+	return nil
+}
+
+// records the address @info sent by the peer @source, unless it was last seen more than
+// @maxAge seconds ago, the address book already has a fresher entry for it or there is
+// no room for it, see AddrBook.learn. Returns whether the address book changed
+func (book *AddrBook) Merge(info AddrInfo, maxAge int64, source string) bool {
+	now := util.Now()
+	timestamp := info.Timestamp
+	if timestamp > now+MaxAddrClockSkew {
+		return false
+	}
+	if timestamp > now {
+		timestamp = now
+	}
+	if timestamp < now-maxAge {
+		return false
+	}
+	book.Lock.Lock()
+	defer book.Lock.Unlock()
+	if existing, ok := book.Entries[info.Addr]; ok && existing.LastSeen >= timestamp {
+		return false
+	}
+	entry, ok := book.learn(info.Addr, source, timestamp)
+	if !ok {
+		return false
+	}
+	entry.PeerId = info.PeerId
+	entry.LastSeen = timestamp
+	book.dirty = true
+	return true
+}
+
+// addresses the current node knows, with the current node and its peers first, the
+// rest sampled at random from the fresh entries of the address book
+func (network *Network) AddrSample() *Addr {
+	now := util.Now()
+	maxAge := int64(time.Duration(network.Config.AddrMaxAge) / time.Second)
+	entries := []AddrInfo{{network.NodeId, network.NodeAddr, now}}
+	included := map[string]bool{network.NodeAddr: true}
+
+	network.PeersLock.RLock()
+	for _, peer := range network.Peers {
+		if len(entries) < MaxAddrEntries && peer.Addr != "" && !included[peer.Addr] {
+			entries = append(entries, AddrInfo{peer.Id, peer.Addr, now})
+			included[peer.Addr] = true
+		}
+	}
+	network.PeersLock.RUnlock()
+
+	book := []AddrInfo{}
+	network.AddrBook.Lock.RLock()
+	for _, entry := range network.AddrBook.Entries {
+		if entry.PeerId != "" && entry.LastSeen >= now-maxAge && !included[entry.Addr] {
+			book = append(book, AddrInfo{entry.PeerId, entry.Addr, entry.LastSeen})
+		}
+	}
+	network.AddrBook.Lock.RUnlock()
+	rand.Shuffle(len(book), func(i, j int) { book[i], book[j] = book[j], book[i] })
+	for _, entry := range book {
+		if len(entries) >= MaxAddrEntries {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return &Addr{entries}
+}
+
+// sends a sample of the known addresses to every peer each Config.AddrInterval
+func (network *Network) StartAddrGossip() {
+	for {
+		select {
+		case <-network.quit:
+			return
+		case <-time.After(time.Duration(network.Config.AddrInterval)):
+		}
+		network.SendAddrs()
+	}
+}
+
+func (network *Network) SendAddrs() {
+	if network.NodeAddr == "" {
+		return
+	}
+	msg := network.AddrSample()
+	network.ConnsLock.RLock()
+	for _, connInfo := range network.Conns {
+		if connInfo.GetHello() != nil && connInfo.Supports("ADDR") && network.authorized(connInfo) {
+			connInfo.SendMessage(msg)
+		}
+	}
+	network.ConnsLock.RUnlock()
+}
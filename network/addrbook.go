@@ -0,0 +1,241 @@
+package network
+
+// Address book of the known peers, persisted as a JSON file.
+//
+// Addresses are learned from the seeds of the configuration, from the peers that
+// connect to the current node and from PEER-ADD and ADDR messages, see addr.go. Each
+// address remembers when its peer was last seen and how many times in a row dialing it
+// failed, which is used by the connection manager to retry it with exponential backoff.
+// The book keeps at most MaxAddrBookSize addresses. To make room for new ones the least
+// recently seen address learned from other peers is evicted, and only when there is none
+// the least recently seen address the node connected to. Seeds are never evicted, and a
+// single peer can't add more than MaxAddrsPerSource of the addresses the node did not
+// connect to, so a peer flooding ADDR messages can't push out the known-good addresses.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/impadalko/CES27Projeto/util"
+)
+
+const (
+	MaxAddrBookSize   = 1000 // maximum number of addresses in the address book
+	MaxAddrsPerSource = 250  // maximum number of unverified addresses added by one peer
+)
+
+type AddrEntry struct {
+	Addr        string `json:"addr"`
+	PeerId      string `json:"peerId"`      // empty when the peer was never connected
+	LastSeen    int64  `json:"lastSeen"`    // seconds since 01/01/1970 UTC, 0 when never seen
+	Failures    int    `json:"failures"`    // consecutive failed attempts to connect
+	NextAttempt int64  `json:"nextAttempt"` // the address is not dialed before this time
+	Seed        bool   `json:"seed"`        // seeds of the configuration are never evicted
+	Verified    bool   `json:"verified"`    // whether the current node was connected to the peer
+	Source      string `json:"source"`      // peerId of the peer that sent the address, if not verified
+}
+
+type AddrBook struct {
+	Filename string
+	Entries  map[string]*AddrEntry // map: addr string => entry
+	Lock     sync.RWMutex
+	dirty    bool
+	sources  map[string]int // map: peerId string => number of unverified entries it added
+}
+
+// reads the address book from @filename, an empty address book is returned if the
+// file does not exist. An address book with an empty @filename is not persisted
+func LoadAddrBook(filename string) (*AddrBook, error) {
+	book := AddrBook{Filename: filename, Entries: map[string]*AddrEntry{}, sources: map[string]int{}}
+	if filename == "" {
+		return &book, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &book, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []*AddrEntry{}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		book.Entries[entry.Addr] = entry
+		if !entry.Verified && entry.Source != "" {
+			book.sources[entry.Source]++
+		}
+	}
+	return &book, nil
+}
+
+// writes the address book to its file, if it changed since the last save
+func (book *AddrBook) Save() error {
+	book.Lock.Lock()
+	defer book.Lock.Unlock()
+	if book.Filename == "" || !book.dirty {
+		return nil
+	}
+	entries := []*AddrEntry{}
+	for _, entry := range book.Entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Addr < entries[j].Addr })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(book.Filename, data, 0644)
+	if err != nil {
+		return err
+	}
+	book.dirty = false
+	return nil
+}
+
+// the entry evicted to make room for a new one: the least recently seen entry that is
+// not verified, or if there is none and @verified is true the least recently seen entry
+// that is verified. Seeds are never evicted
+func (book *AddrBook) evictable(verified bool) *AddrEntry {
+	var oldest *AddrEntry
+	for _, entry := range book.Entries {
+		if entry.Seed || entry.Verified && !verified {
+			continue
+		}
+		if oldest == nil || oldest.Verified && !entry.Verified ||
+			oldest.Verified == entry.Verified && entry.LastSeen < oldest.LastSeen {
+			oldest = entry
+		}
+	}
+	return oldest
+}
+
+// stops counting the entry as added by its source
+func (book *AddrBook) forgetSource(entry *AddrEntry) {
+	if entry.Verified || entry.Source == "" {
+		return
+	}
+	book.sources[entry.Source]--
+	if book.sources[entry.Source] == 0 {
+		delete(book.sources, entry.Source)
+	}
+	entry.Source = ""
+}
+
+func (book *AddrBook) remove(entry *AddrEntry) {
+	book.forgetSource(entry)
+	delete(book.Entries, entry.Addr)
+}
+
+// the entry of @addr, created if needed. A new entry evicts another one when the address
+// book is full
+func (book *AddrBook) entry(addr string) *AddrEntry {
+	entry, ok := book.Entries[addr]
+	if !ok {
+		if len(book.Entries) >= MaxAddrBookSize {
+			if oldest := book.evictable(true); oldest != nil {
+				book.remove(oldest)
+			}
+		}
+		entry = &AddrEntry{Addr: addr}
+		book.Entries[addr] = entry
+	}
+	book.dirty = true
+	return entry
+}
+
+// the entry of the address @addr sent by the peer @source and last seen at @lastSeen,
+// created if needed. A new entry is only created if the peer did not add too many
+// entries and, when the address book is full, it is fresher than an entry that is not
+// verified, which is evicted
+func (book *AddrBook) learn(addr string, source string, lastSeen int64) (*AddrEntry, bool) {
+	if entry, ok := book.Entries[addr]; ok {
+		return entry, true
+	}
+	if source != "" && book.sources[source] >= MaxAddrsPerSource {
+		return nil, false
+	}
+	if len(book.Entries) >= MaxAddrBookSize {
+		oldest := book.evictable(false)
+		if oldest == nil || oldest.LastSeen >= lastSeen {
+			return nil, false
+		}
+		book.remove(oldest)
+	}
+	entry := book.entry(addr)
+	if source != "" {
+		entry.Source = source
+		book.sources[source]++
+	}
+	return entry, true
+}
+
+// adds a seed of the configuration
+func (book *AddrBook) AddSeed(addr string) {
+	book.Lock.Lock()
+	book.entry(addr).Seed = true
+	book.Lock.Unlock()
+}
+
+// adds an address sent by the peer @source, which is connected to it, @peerId may be
+// empty
+func (book *AddrBook) Add(addr string, peerId string, source string) {
+	book.Lock.Lock()
+	entry, ok := book.learn(addr, source, util.Now())
+	if ok && peerId != "" {
+		entry.PeerId = peerId
+		book.dirty = true
+	}
+	book.Lock.Unlock()
+}
+
+// records that the peer @peerId at @addr is connected
+func (book *AddrBook) MarkSeen(addr string, peerId string) {
+	book.Lock.Lock()
+	entry := book.entry(addr)
+	book.forgetSource(entry)
+	entry.Verified = true
+	entry.PeerId = peerId
+	entry.LastSeen = util.Now()
+	entry.Failures = 0
+	entry.NextAttempt = 0
+	book.Lock.Unlock()
+}
+
+// records a failed attempt to connect to @addr, it will only be retried after a delay
+// that doubles with each consecutive failure, from @backoffMin up to @backoffMax
+func (book *AddrBook) MarkFailed(addr string, backoffMin time.Duration, backoffMax time.Duration) {
+	book.Lock.Lock()
+	entry := book.entry(addr)
+	backoff := backoffMin
+	for i := 0; i < entry.Failures && backoff < backoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > backoffMax {
+		backoff = backoffMax
+	}
+	entry.Failures++
+	entry.NextAttempt = util.Now() + int64(backoff/time.Second)
+	book.Lock.Unlock()
+}
+
+// addresses that may be dialed now, the most recently seen first
+func (book *AddrBook) Candidates() []AddrEntry {
+	now := util.Now()
+	candidates := []AddrEntry{}
+	book.Lock.RLock()
+	for _, entry := range book.Entries {
+		if entry.NextAttempt <= now {
+			candidates = append(candidates, *entry)
+		}
+	}
+	book.Lock.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].LastSeen > candidates[j].LastSeen })
+	return candidates
+}
@@ -0,0 +1,198 @@
+package network
+
+// Misbehaviour scores and bans.
+//
+// Each connection accumulates a score for the misbehaviour of its peer, such as messages
+// that can't be decoded, unknown message types, invalid blocks or spam. When the score
+// reaches Config.BanThreshold the peer is disconnected and banned for Config.BanDuration,
+// both by its peerId and by its IP, so reconnecting with another peerId does not help.
+//
+// The ban list is persisted as a JSON file. Banned peers are not accepted nor dialed.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/impadalko/CES27Projeto/util"
+)
+
+// misbehaviour scores
+const (
+	ScoreMalformed    = 20 // message that can't be decoded or fails validation
+	ScoreUnknownType  = 10 // message type that is not registered
+	ScoreInvalidBlock = 25 // block that does not fit the blockchain
+	ScoreSpam         = 5  // message that is unexpected or sent too often
+)
+
+type BanEntry struct {
+	Target string `json:"target"` // peerId or IP
+	Until  int64  `json:"until"`  // seconds since 01/01/1970 UTC
+	Reason string `json:"reason"`
+}
+
+type BanList struct {
+	Filename string
+	Entries  map[string]*BanEntry // map: target string => entry
+	Lock     sync.RWMutex
+}
+
+// reads the ban list from @filename, an empty ban list is returned if the file does
+// not exist. A ban list with an empty @filename is not persisted
+func LoadBanList(filename string) (*BanList, error) {
+	banList := BanList{Filename: filename, Entries: map[string]*BanEntry{}}
+	if filename == "" {
+		return &banList, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &banList, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []*BanEntry{}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		banList.Entries[entry.Target] = entry
+	}
+	return &banList, nil
+}
+
+func (banList *BanList) Save() error {
+	if banList.Filename == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(banList.List(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(banList.Filename, data, 0644)
+}
+
+func (banList *BanList) Ban(target string, duration time.Duration, reason string) error {
+	banList.Lock.Lock()
+	banList.Entries[target] = &BanEntry{target, util.Now() + int64(duration/time.Second), reason}
+	banList.Lock.Unlock()
+	return banList.Save()
+}
+
+func (banList *BanList) Unban(target string) error {
+	banList.Lock.Lock()
+	delete(banList.Entries, target)
+	banList.Lock.Unlock()
+	return banList.Save()
+}
+
+// whether any of the @targets is banned, empty targets are ignored
+func (banList *BanList) IsBanned(targets ...string) bool {
+	now := util.Now()
+	banList.Lock.RLock()
+	defer banList.Lock.RUnlock()
+	for _, target := range targets {
+		entry, ok := banList.Entries[target]
+		if target != "" && ok && entry.Until > now {
+			return true
+		}
+	}
+	return false
+}
+
+// the bans that did not expire yet, ordered by target
+func (banList *BanList) List() []BanEntry {
+	now := util.Now()
+	entries := []BanEntry{}
+	banList.Lock.RLock()
+	for _, entry := range banList.Entries {
+		if entry.Until > now {
+			entries = append(entries, *entry)
+		}
+	}
+	banList.Lock.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Target < entries[j].Target })
+	return entries
+}
+
+// the IP of the remote end of @conn, empty if it is not an IP address
+func RemoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// whether the peer @peerId or the host of @addr is banned, any of them may be empty
+func (network *Network) IsBanned(peerId string, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = ""
+	}
+	return network.BanList.IsBanned(peerId, host)
+}
+
+// adds @score to the misbehaviour score of the peer of the connection, the peer is
+// banned when its score reaches Config.BanThreshold
+func (network *Network) Misbehave(connInfo *ConnInfo, score int, reason string) {
+	connInfo.Lock.Lock()
+	connInfo.Score += score
+	total := connInfo.Score
+	connInfo.Lock.Unlock()
+	peerId, _ := connInfo.GetPeer()
+	fmt.Printf("Misbehaviour of %s: %s (score %d)\n\n", peerId, reason, total)
+
+	if total >= network.Config.BanThreshold {
+		network.BanConn(connInfo, time.Duration(network.Config.BanDuration), reason)
+	}
+}
+
+// bans the peer of the connection by its peerId and IP, and closes the connection
+func (network *Network) BanConn(connInfo *ConnInfo, duration time.Duration, reason string) {
+	peerId, _ := connInfo.GetPeer()
+	for _, target := range []string{peerId, RemoteIP(connInfo.Conn)} {
+		if target == "" {
+			continue
+		}
+		err := network.BanList.Ban(target, duration, reason)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	ctx := Context{Network: network, ConnInfo: connInfo}
+	ctx.Disconnect("banned: " + reason)
+}
+
+// bans @target, a peerId or an IP, and disconnects the peers it matches
+func (network *Network) Ban(target string, duration time.Duration, reason string) error {
+	err := network.BanList.Ban(target, duration, reason)
+	if err != nil {
+		return err
+	}
+	network.ConnsLock.RLock()
+	conns := []*ConnInfo{}
+	for _, connInfo := range network.Conns {
+		peerId, _ := connInfo.GetPeer()
+		if peerId == target || RemoteIP(connInfo.Conn) == target {
+			conns = append(conns, connInfo)
+		}
+	}
+	network.ConnsLock.RUnlock()
+	for _, connInfo := range conns {
+		ctx := Context{Network: network, ConnInfo: connInfo}
+		ctx.Disconnect("banned: " + reason)
+	}
+	return nil
+}
+
+// adds @score to the misbehaviour score of the peer that sent the message
+func (ctx *Context) Misbehave(score int, reason string) {
+	ctx.Network.Misbehave(ctx.ConnInfo, score, reason)
+}
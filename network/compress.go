@@ -0,0 +1,109 @@
+package network
+
+// Compression of large binary frames.
+//
+// Peers that both advertise FeatureDeflate in the features of their HELLO may send
+// binary frames with a payload compressed with DEFLATE:
+//
+//     magic     1 byte              CompressedFrameMagic
+//     typeLen   1 byte              length of the message type
+//     type      typeLen bytes
+//     length    4 bytes big-endian  length of the compressed payload
+//     rawLength 4 bytes big-endian  length of the payload once decompressed
+//     payload   length bytes
+//     checksum  4 bytes big-endian  CRC-32 of type and compressed payload
+//
+// Only payloads of at least Config.CompressionThreshold bytes are compressed, like the
+// batches of blocks sent when syncing, and only when compression makes them shorter.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const CompressedFrameMagic = 0xCF
+
+// capability advertised in HELLO by the nodes that accept compressed frames
+const FeatureDeflate = "deflate"
+
+// encodes @msg in the binary format, compressing its payload if it has at least
+// @threshold bytes. Returns the length of the payload before compression, 0 if it
+// was not compressed
+func EncodeCompressed(msg Message, threshold int) ([]byte, int, error) {
+	messageType, payload, err := encodePayload(msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(payload) < threshold {
+		return binaryFrame(messageType, payload), 0, nil
+	}
+
+	compressed := bytes.Buffer{}
+	writer, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if err != nil {
+		return nil, 0, err
+	}
+	writer.Write(payload)
+	err = writer.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	if compressed.Len() >= len(payload) {
+		return binaryFrame(messageType, payload), 0, nil
+	}
+
+	frame := bytes.Buffer{}
+	frame.WriteByte(CompressedFrameMagic)
+	frame.WriteByte(byte(len(messageType)))
+	frame.WriteString(messageType)
+	binary.Write(&frame, binary.BigEndian, uint32(compressed.Len()))
+	binary.Write(&frame, binary.BigEndian, uint32(len(payload)))
+	frame.Write(compressed.Bytes())
+	binary.Write(&frame, binary.BigEndian, checksum(messageType, compressed.Bytes()))
+	return frame.Bytes(), len(payload), nil
+}
+
+// decompresses @payload, failing if it does not have exactly @rawLength bytes once
+// decompressed. Never decompresses more than @rawLength+1 bytes
+func decompress(payload []byte, rawLength int) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(payload))
+	defer reader.Close()
+	raw := bytes.Buffer{}
+	_, err := io.Copy(&raw, io.LimitReader(reader, int64(rawLength)+1))
+	if err != nil {
+		return nil, err
+	}
+	if raw.Len() != rawLength {
+		return nil, errors.New("Decompressed payload length mismatch")
+	}
+	return raw.Bytes(), nil
+}
+
+// the length before compression of the payload of the next frame, if it is compressed
+func peekRawLength(reader *bufio.Reader) (int, bool) {
+	header, err := reader.Peek(1)
+	if err != nil || header[0] != CompressedFrameMagic {
+		return 0, false
+	}
+	header, err = reader.Peek(2)
+	if err != nil {
+		return 0, false
+	}
+	offset := 2 + int(header[1]) + 4
+	header, err = reader.Peek(offset + 4)
+	if err != nil {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint32(header[offset:])), true
+}
+
+// whether messages sent on the connection may be compressed
+func (connInfo *ConnInfo) Compresses() bool {
+	hello := connInfo.GetHello()
+	return connInfo.CompressionThreshold > 0 && connInfo.Version() >= BinaryFramingVersion &&
+		hello != nil && hello.HasFeature(FeatureDeflate)
+}
@@ -0,0 +1,184 @@
+package network
+
+// Tunable parameters of a network, they can be read from a JSON configuration file
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+type Config struct {
+	// name of the transport of the connections, see transport.go
+	Transport string `json:"transport"`
+
+	// address the node listens on, ":0" picks a random port
+	ListenAddr string `json:"listenAddr"`
+
+	// timeout of a Call when its context has no deadline
+	CallTimeout Duration `json:"callTimeout"`
+
+	// timeout of dialing a peer
+	DialTimeout Duration `json:"dialTimeout"`
+
+	// when Gossip is set, each node keeps a bounded set of peers instead of connecting
+	// to every node, and messages sent with Network.Gossip are relayed between peers
+	Gossip         bool `json:"gossip"`
+	TargetOutbound int  `json:"targetOutbound"` // number of peers the node connects to
+	MaxInbound     int  `json:"maxInbound"`     // number of peers the node accepts connections from
+	Fanout         int  `json:"fanout"`         // number of peers a gossiped message is relayed to, 0 relays to all
+	GossipTTL      int  `json:"gossipTTL"`      // number of hops a gossiped message travels
+	SeenCacheSize  int  `json:"seenCacheSize"`  // number of gossiped message ids remembered to suppress duplicates
+
+	// number of inventory items remembered per peer as known by the peer
+	KnownInventorySize int `json:"knownInventorySize"`
+
+	// the connection manager keeps TargetPeers peers, dialing the seeds and the addresses
+	// of the address book. Failed addresses are retried with exponential backoff
+	Seeds             []string `json:"seeds"`
+	AddrBookFile      string   `json:"addrBookFile"` // the address book is only kept in memory when empty
+	TargetPeers       int      `json:"targetPeers"`
+	ReconnectInterval Duration `json:"reconnectInterval"`
+	BackoffMin        Duration `json:"backoffMin"`
+	BackoffMax        Duration `json:"backoffMax"`
+
+	// address gossip, see addr.go
+	AddrInterval Duration `json:"addrInterval"`
+	AddrMaxAge   Duration `json:"addrMaxAge"` // older addresses are neither sent nor merged
+
+	// payloads of binary frames of at least this size are compressed, 0 disables
+	// compression, see compress.go
+	CompressionThreshold int `json:"compressionThreshold"`
+
+	// the node follows the network without relaying or submitting data, see observer.go
+	Observer bool `json:"observer"`
+
+	// heartbeats, see heartbeat.go
+	PingInterval   Duration `json:"pingInterval"`
+	MaxMissedPings int      `json:"maxMissedPings"`
+	WriteTimeout   Duration `json:"writeTimeout"`
+
+	// messages queued per connection before SendQueuePolicy is applied, see queue.go
+	SendQueueSize   int    `json:"sendQueueSize"`
+	SendQueuePolicy string `json:"sendQueuePolicy"` // QueueDrop or QueueDisconnect
+
+	// peers are banned when their misbehaviour score reaches BanThreshold, see ban.go
+	BanListFile  string   `json:"banListFile"` // the ban list is only kept in memory when empty
+	BanThreshold int      `json:"banThreshold"`
+	BanDuration  Duration `json:"banDuration"`
+
+	// resource limits, see limits.go
+	MaxMessageSize   int                  `json:"maxMessageSize"` // bytes, at most MaxPayloadSize
+	MaxInboundConns  int                  `json:"maxInboundConns"`
+	MaxOutboundConns int                  `json:"maxOutboundConns"`
+	MaxConnsPerIP    int                  `json:"maxConnsPerIP"`
+	RateLimits       map[string]RateLimit `json:"rateLimits"` // map: messageType string => limit
+	DefaultRateLimit RateLimit            `json:"defaultRateLimit"`
+}
+
+func (network *Network) SetConfig(config Config) {
+	network.Config = config
+	if transport, ok := Transports[config.Transport]; ok {
+		network.Transport = transport
+	}
+	network.Seen = NewSeenCache(config.SeenCacheSize)
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Transport:      "tcp",
+		ListenAddr:     AnyAddr,
+		CallTimeout:    Duration(10 * time.Second),
+		DialTimeout:    Duration(5 * time.Second),
+		Gossip:         false,
+		TargetOutbound: 4,
+		MaxInbound:     16,
+		Fanout:         0,
+		GossipTTL:      16,
+		SeenCacheSize:  4096,
+
+		KnownInventorySize: 4096,
+
+		Seeds:             []string{},
+		AddrBookFile:      "",
+		TargetPeers:       8,
+		ReconnectInterval: Duration(5 * time.Second),
+		BackoffMin:        Duration(5 * time.Second),
+		BackoffMax:        Duration(10 * time.Minute),
+
+		AddrInterval: Duration(30 * time.Second),
+		AddrMaxAge:   Duration(3 * time.Hour),
+
+		CompressionThreshold: 1024,
+
+		Observer: false,
+
+		PingInterval:   Duration(10 * time.Second),
+		MaxMissedPings: 3,
+		WriteTimeout:   Duration(10 * time.Second),
+
+		SendQueueSize:   1024,
+		SendQueuePolicy: QueueDisconnect,
+
+		BanListFile:  "",
+		BanThreshold: 100,
+		BanDuration:  Duration(24 * time.Hour),
+
+		MaxMessageSize:   MaxPayloadSize,
+		MaxInboundConns:  64,
+		MaxOutboundConns: 64,
+		MaxConnsPerIP:    16,
+		RateLimits: map[string]RateLimit{
+			// each of these is answered with a lot of data
+			"REQUEST-BLOCKCHAIN": {Rate: 0.2, Burst: 4},
+			"PEER-LIST":          {Rate: 0.2, Burst: 4},
+			"GETDATA":            {Rate: 10, Burst: 100},
+		},
+		DefaultRateLimit: RateLimit{Rate: 100, Burst: 1000},
+	}
+}
+
+// reads the configuration from the JSON file @filename, the fields missing in the file
+// keep their default values. The default configuration is returned if the file does
+// not exist
+func LoadConfig(filename string) (Config, error) {
+	config := DefaultConfig()
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, err
+	}
+	if _, ok := Transports[config.Transport]; !ok {
+		return config, fmt.Errorf("Unknown transport %s", config.Transport)
+	}
+	return config, nil
+}
+
+// a time.Duration written as a string like "10s" in configuration files
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	err := json.Unmarshal(data, &str)
+	if err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
@@ -0,0 +1,121 @@
+package network
+
+// The connection manager keeps the current node connected to Config.TargetPeers peers.
+// Periodically, while the node has less peers than the target, it dials the seeds and
+// the addresses of the address book that are not connected yet. Addresses that fail
+// are retried with exponential backoff, see addrbook.go.
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func (network *Network) StartConnectionManager() {
+	for _, seed := range network.Config.Seeds {
+		network.AddrBook.AddSeed(seed)
+	}
+	for {
+		network.FillPeers()
+		err := network.AddrBook.Save()
+		if err != nil {
+			fmt.Println(err)
+		}
+		select {
+		case <-network.quit:
+			return
+		case <-time.After(time.Duration(network.Config.ReconnectInterval)):
+		}
+	}
+}
+
+// dials addresses of the address book until the node has enough peers. The addresses are
+// dialed at the same time, so unreachable ones don't delay the others
+func (network *Network) FillPeers() {
+	missing := network.Config.TargetPeers - network.CountPeers() - network.Dialing()
+	outbound, _ := network.CountConns()
+	if slots := network.Config.TargetOutbound - outbound - network.Dialing(); network.Config.Gossip && slots < missing {
+		missing = slots
+	}
+	wait := sync.WaitGroup{}
+	for _, candidate := range network.AddrBook.Candidates() {
+		if missing <= 0 {
+			break
+		}
+		if candidate.Addr == network.NodeAddr || candidate.PeerId == network.NodeId {
+			continue
+		}
+		if network.IsConnected(candidate.Addr, candidate.PeerId) {
+			continue
+		}
+		if network.IsBanned(candidate.PeerId, candidate.Addr) {
+			continue
+		}
+		missing--
+		wait.Add(1)
+		atomic.AddInt32(&network.dialing, 1)
+		go func(addr string) {
+			defer wait.Done()
+			conn, err := network.JoinNetwork(addr)
+			atomic.AddInt32(&network.dialing, -1)
+			if err != nil {
+				network.AddrBook.MarkFailed(addr,
+					time.Duration(network.Config.BackoffMin), time.Duration(network.Config.BackoffMax))
+				return
+			}
+			go network.StartHandleConnection(conn)
+		}(candidate.Addr)
+	}
+	wait.Wait()
+}
+
+// dials @peerAddr without blocking the caller, the connection is handled once it is made
+func (network *Network) DialInBackground(peerAddr string) {
+	atomic.AddInt32(&network.dialing, 1)
+	go func() {
+		conn, err := network.Dial(peerAddr)
+		atomic.AddInt32(&network.dialing, -1)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		network.StartHandleConnection(conn)
+	}()
+}
+
+// number of addresses being dialed in the background, they are not connections yet
+func (network *Network) Dialing() int {
+	return int(atomic.LoadInt32(&network.dialing))
+}
+
+func (network *Network) CountPeers() int {
+	network.PeersLock.RLock()
+	count := len(network.Peers)
+	network.PeersLock.RUnlock()
+	return count
+}
+
+// whether the node has a peer with id @peerId or a connection to @addr, including the
+// connections still in the handshake
+func (network *Network) IsConnected(addr string, peerId string) bool {
+	if _, ok := network.GetPeer(peerId); ok {
+		return true
+	}
+	network.PeersLock.RLock()
+	for _, peer := range network.Peers {
+		if peer.Addr == addr {
+			network.PeersLock.RUnlock()
+			return true
+		}
+	}
+	network.PeersLock.RUnlock()
+	network.ConnsLock.RLock()
+	defer network.ConnsLock.RUnlock()
+	for _, connInfo := range network.Conns {
+		if connInfo.DialAddr == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package network
+
+// Gossip overlay over a bounded set of peers.
+//
+// In gossip mode each node dials at most Config.TargetOutbound peers and accepts at most
+// Config.MaxInbound peers, instead of connecting to every node of the network. Messages
+// that must reach every node are wrapped in a GOSSIP message:
+//
+//     GOSSIP <id> <origin> <hops> <type> <fields of the message> ...
+//
+// A node receiving a GOSSIP it has not seen yet handles the wrapped message and relays
+// it to Config.Fanout random peers (all peers when Fanout is 0), other than the peer
+// it was received from. The ids of the messages already seen are remembered in a
+// bounded cache, so duplicates are dropped and messages do not loop. As long as the
+// overlay is connected and the fanout covers the peers, every node receives the message.
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+
+	"github.com/impadalko/CES27Projeto/util"
+)
+
+type Gossip struct {
+	Id     string // random id used to suppress duplicates
+	Origin string // nodeId of the node that created the message
+	Hops   int64  // number of times the message was relayed
+	Msg    Message
+
+	newMessage func(messageType string) Message
+}
+
+func (msg *Gossip) Type() string { return "GOSSIP" }
+
+func (msg *Gossip) Encode(enc Encoder) {
+	enc.String(msg.Id)
+	enc.String(msg.Origin)
+	enc.Int(msg.Hops)
+	enc.String(msg.Msg.Type())
+	msg.Msg.Encode(enc)
+}
+
+func (msg *Gossip) Decode(dec Decoder) {
+	msg.Id = dec.String()
+	msg.Origin = dec.String()
+	msg.Hops = dec.Int()
+	msg.Msg = decodeWrapped(dec, msg.newMessage)
+}
+
+func ValidateGossip(msg Message) error {
+	gossip := msg.(*Gossip)
+	if gossip.Id == "" || gossip.Hops < 0 || gossip.Msg == nil {
+		return errors.New("Invalid GOSSIP fields")
+	}
+	return validatePeerId(gossip.Origin)
+}
+
+func HandleGossip(ctx *Context, msg Message) error {
+	// the other peer relayed a message that must reach every node
+	gossip := msg.(*Gossip)
+	network := ctx.Network
+
+	if !network.Seen.Add(gossip.Id) || gossip.Origin == network.NodeId {
+		// duplicate
+		return nil
+	}
+	// the wrapped message goes through the middlewares like any other message
+	err := network.chain()(ctx, gossip.Msg)
+	if err != nil {
+		// invalid messages are not relayed
+		return err
+	}
+	if gossip.Hops+1 < int64(network.Config.GossipTTL) {
+		network.relay(&Gossip{gossip.Id, gossip.Origin, gossip.Hops + 1, gossip.Msg, nil}, ctx.ConnInfo)
+	}
+	return nil
+}
+
+// sends @msg to every node of the network. Peers that do not support GOSSIP receive
+// the message itself, but will not relay it
+func (network *Network) Gossip(msg Message) {
+	gossip := Gossip{util.RandomString(16), network.NodeId, 0, msg, nil}
+	network.Seen.Add(gossip.Id)
+
+	network.ConnsLock.RLock()
+	for _, connInfo := range network.Conns {
+		if connInfo.Supports("GOSSIP") && connInfo.Supports(msg.Type()) {
+			connInfo.SendMessage(&gossip)
+		} else if connInfo.Supports(msg.Type()) {
+			connInfo.SendMessage(msg)
+		}
+	}
+	network.ConnsLock.RUnlock()
+}
+
+// sends @gossip to Config.Fanout random peers, other than @from
+func (network *Network) relay(gossip *Gossip, from *ConnInfo) {
+	if network.IsObserver() {
+		// observers only receive gossip
+		return
+	}
+	targets := []*ConnInfo{}
+	network.ConnsLock.RLock()
+	for _, connInfo := range network.Conns {
+		if connInfo != from && connInfo.Supports("GOSSIP") && connInfo.Supports(gossip.Msg.Type()) {
+			targets = append(targets, connInfo)
+		}
+	}
+	network.ConnsLock.RUnlock()
+
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	if network.Config.Fanout > 0 && len(targets) > network.Config.Fanout {
+		targets = targets[:network.Config.Fanout]
+	}
+	for _, connInfo := range targets {
+		connInfo.SendMessage(gossip)
+	}
+}
+
+// number of connections of the current node it dialed and accepted, including the ones
+// still in the handshake
+func (network *Network) CountConns() (outbound int, inbound int) {
+	network.ConnsLock.RLock()
+	for _, connInfo := range network.Conns {
+		if connInfo.Outbound {
+			outbound++
+		} else {
+			inbound++
+		}
+	}
+	network.ConnsLock.RUnlock()
+	return outbound, inbound
+}
+
+// whether the current node should dial another peer
+func (network *Network) WantsOutbound() bool {
+	if !network.Config.Gossip {
+		return true
+	}
+	outbound, _ := network.CountConns()
+	return outbound+network.Dialing() < network.Config.TargetOutbound
+}
+
+// whether the current node should accept another peer
+func (network *Network) AcceptsInbound() bool {
+	if !network.Config.Gossip {
+		return true
+	}
+	// the connection of the requesting peer is already counted
+	_, inbound := network.CountConns()
+	return inbound <= network.Config.MaxInbound
+}
+
+// bounded set of recently seen message ids, the oldest ids are forgotten first
+type SeenCache struct {
+	ids   map[string]bool
+	order []string
+	size  int
+	lock  sync.Mutex
+}
+
+func NewSeenCache(size int) *SeenCache {
+	return &SeenCache{map[string]bool{}, []string{}, size, sync.Mutex{}}
+}
+
+func (cache *SeenCache) Has(id string) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.ids[id]
+}
+
+// adds @id to the cache, returns false if it was already there
+func (cache *SeenCache) Add(id string) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.ids[id] {
+		return false
+	}
+	cache.ids[id] = true
+	cache.order = append(cache.order, id)
+	for len(cache.order) > cache.size {
+		delete(cache.ids, cache.order[0])
+		cache.order = cache.order[1:]
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+package network
+
+// Protocol version and capability negotiation.
+//
+// Right after PEER-REQUEST (or PEER-ACCEPTED) each side sends a HELLO message:
+//
+//     HELLO <version> <chainId> <height> <feature,feature,...>
+//
+// The rules applied to the HELLO of a peer are:
+//   - a peer whose version is lower than MinProtocolVersion is rejected
+//   - a peer whose version is higher than ProtocolVersion is accepted, both sides
+//     talk using the lowest of the two versions
+//   - a peer on a different chain (different genesis block) is rejected, unless one
+//     of the sides does not have a blockchain yet ("-")
+//   - no message other than the handshake messages is accepted before the HELLO, and
+//     a second HELLO on the same connection is rejected
+//   - a message is only sent to a peer if its type was advertised in the features
+//     of the peer
+//
+// Version 1 peers only understand the text format, version 2 introduced the binary
+// framing described in message.go.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	ProtocolVersion    = 2 // version of the protocol spoken by the current node
+	MinProtocolVersion = 1 // oldest version of a peer the current node is able to talk to
+)
+
+// the chainId used by a node that does not have a blockchain yet
+const NoChainId = "-"
+
+// messages that may be exchanged before the HELLO of the peer is received
+var handshakeMessages = []string{"PEER-REQUEST", "PEER-ACCEPTED", "HELLO"}
+
+type Hello struct {
+	Version  int
+	ChainId  string   // hash of the genesis block of the blockchain of the peer
+	Height   int64    // number of blocks in the blockchain of the peer
+	Features []string // message types and capabilities supported by the peer
+}
+
+func (hello *Hello) Type() string { return "HELLO" }
+
+func (hello *Hello) Encode(enc Encoder) {
+	enc.Int(int64(hello.Version))
+	enc.String(hello.ChainId)
+	enc.Int(hello.Height)
+	enc.Strings(hello.Features)
+}
+
+func (hello *Hello) Decode(dec Decoder) {
+	hello.Version = int(dec.Int())
+	hello.ChainId = dec.String()
+	hello.Height = dec.Int()
+	hello.Features = dec.Strings()
+}
+
+func (hello *Hello) HasFeature(feature string) bool {
+	for _, f := range hello.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// the HELLO message describing the current node
+func (network *Network) Hello() *Hello {
+	chainId, height := NoChainId, int64(0)
+	if network.ChainInfo != nil {
+		chainId, height = network.ChainInfo()
+	}
+	return &Hello{ProtocolVersion, chainId, height, network.Features()}
+}
+
+// message types supported by the current node, registered with AddHandler, and its
+// capabilities
+func (network *Network) Features() []string {
+	features := []string{}
+	network.HandlersLock.RLock()
+	for messageType := range network.Handlers {
+		features = append(features, messageType)
+	}
+	network.HandlersLock.RUnlock()
+	if network.Config.CompressionThreshold > 0 {
+		features = append(features, FeatureDeflate)
+	}
+	if network.Config.Observer {
+		features = append(features, FeatureObserver)
+	}
+	sort.Strings(features)
+	return features
+}
+
+func ValidateHello(msg Message) error {
+	hello := msg.(*Hello)
+	if hello.Version <= 0 || hello.Height < 0 || hello.ChainId == "" {
+		return errors.New("Invalid HELLO fields")
+	}
+	return nil
+}
+
+func HandleHello(ctx *Context, msg Message) error {
+	// the other peer sent its protocol version and capabilities
+	hello := msg.(*Hello)
+
+	if ctx.ConnInfo.GetHello() != nil {
+		ctx.Misbehave(ScoreSpam, "duplicate HELLO")
+		return errors.New("The peer already sent its HELLO")
+	}
+	err := ctx.Network.CheckHello(hello)
+	if err != nil {
+		ctx.ConnInfo.Close()
+		return err
+	}
+	ctx.ConnInfo.SetHello(hello)
+
+	if ctx.Network.authorized(ctx.ConnInfo) {
+		ctx.Network.Introduce(ctx.ConnInfo)
+	}
+	if ctx.Network.OnHandshake != nil {
+		ctx.Network.OnHandshake(ctx.ConnInfo)
+	}
+	return nil
+}
+
+// sends the addresses known by the current node and its subscriptions to a new peer,
+// instead of waiting for the next ADDR gossip
+func (network *Network) Introduce(connInfo *ConnInfo) {
+	if connInfo.Supports("ADDR") {
+		connInfo.SendMessage(network.AddrSample())
+	}
+	if topics := network.Topics(); len(topics) > 0 && connInfo.Supports("SUBSCRIPTIONS") {
+		connInfo.SendMessage(&Subscriptions{topics})
+	}
+}
+
+func (network *Network) authorized(connInfo *ConnInfo) bool {
+	return network.Authorized == nil || network.Authorized(connInfo)
+}
+
+// verifies that the peer that sent @hello is compatible with the current node
+func (network *Network) CheckHello(hello *Hello) error {
+	if hello.Version < MinProtocolVersion {
+		return fmt.Errorf("Incompatible protocol version %d, minimum is %d", hello.Version, MinProtocolVersion)
+	}
+	own := network.Hello()
+	if own.ChainId != NoChainId && hello.ChainId != NoChainId && own.ChainId != hello.ChainId {
+		return errors.New("Peer is on a different blockchain")
+	}
+	return nil
+}
+
+// returns whether the peer of the connection is able to handle messages of @messageType
+func (connInfo *ConnInfo) Supports(messageType string) bool {
+	for _, m := range handshakeMessages {
+		if m == messageType {
+			return true
+		}
+	}
+	hello := connInfo.GetHello()
+	return hello != nil && hello.HasFeature(messageType)
+}
+
+// the protocol version used with the peer of the connection, the lowest of both versions
+func (connInfo *ConnInfo) Version() int {
+	hello := connInfo.GetHello()
+	if hello == nil || hello.Version < MinProtocolVersion {
+		return MinProtocolVersion
+	}
+	if hello.Version < ProtocolVersion {
+		return hello.Version
+	}
+	return ProtocolVersion
+}
@@ -0,0 +1,105 @@
+package network
+
+// Heartbeats and dead peer detection.
+//
+// Every Config.PingInterval a PING is sent to each peer that supports it, and the peer
+// answers with a PONG carrying the same nonce, which gives the round trip time of the
+// connection. A peer that misses Config.MaxMissedPings PONGs in a row is disconnected.
+//
+// Besides that, reads on a connection time out when nothing was received for as long
+// as the peer should have taken to send Config.MaxMissedPings PINGs, and writes time out
+// after Config.WriteTimeout, so half-open connections do not stay around forever.
+
+import (
+	"math/rand"
+	"time"
+)
+
+type Ping struct {
+	Nonce int64
+}
+
+func (msg *Ping) Type() string       { return "PING" }
+func (msg *Ping) Encode(enc Encoder) { enc.Int(msg.Nonce) }
+func (msg *Ping) Decode(dec Decoder) { msg.Nonce = dec.Int() }
+
+type Pong struct {
+	Nonce int64
+}
+
+func (msg *Pong) Type() string       { return "PONG" }
+func (msg *Pong) Encode(enc Encoder) { enc.Int(msg.Nonce) }
+func (msg *Pong) Decode(dec Decoder) { msg.Nonce = dec.Int() }
+
+func HandlePing(ctx *Context, msg Message) error {
+	// the other peer checks that the current node is alive
+	return ctx.Reply(&Pong{msg.(*Ping).Nonce})
+}
+
+func HandlePong(ctx *Context, msg Message) error {
+	// the other peer answered a PING of the current node
+	connInfo := ctx.ConnInfo
+	connInfo.Lock.Lock()
+	if msg.(*Pong).Nonce == connInfo.pingNonce {
+		connInfo.RTT = time.Since(connInfo.pingSent)
+		connInfo.missedPings = 0
+		connInfo.pingNonce = 0
+	}
+	connInfo.Lock.Unlock()
+	return nil
+}
+
+// sends a PING to every peer each Config.PingInterval
+func (network *Network) StartHeartbeat() {
+	for {
+		select {
+		case <-network.quit:
+			return
+		case <-time.After(time.Duration(network.Config.PingInterval)):
+		}
+		network.SendPings()
+	}
+}
+
+// sends a PING to every peer, the peers that missed too many PONGs are disconnected
+func (network *Network) SendPings() {
+	network.ConnsLock.RLock()
+	conns := []*ConnInfo{}
+	for _, connInfo := range network.Conns {
+		if connInfo.GetHello() != nil && connInfo.Supports("PING") {
+			conns = append(conns, connInfo)
+		}
+	}
+	network.ConnsLock.RUnlock()
+
+	for _, connInfo := range conns {
+		connInfo.Lock.Lock()
+		if connInfo.pingNonce != 0 {
+			connInfo.missedPings++
+		}
+		missedPings := connInfo.missedPings
+		connInfo.pingNonce = rand.Int63() + 1
+		connInfo.pingSent = time.Now()
+		nonce := connInfo.pingNonce
+		connInfo.Lock.Unlock()
+
+		if missedPings >= network.Config.MaxMissedPings {
+			ctx := Context{Network: network, ConnInfo: connInfo}
+			ctx.Disconnect("missed heartbeats")
+			continue
+		}
+		connInfo.SendMessage(&Ping{nonce})
+	}
+}
+
+// how long a connection may stay silent before it is considered dead
+func (network *Network) ReadTimeout() time.Duration {
+	return time.Duration(network.Config.PingInterval) * time.Duration(network.Config.MaxMissedPings+1)
+}
+
+func (connInfo *ConnInfo) GetRTT() time.Duration {
+	connInfo.Lock.RLock()
+	rtt := connInfo.RTT
+	connInfo.Lock.RUnlock()
+	return rtt
+}
@@ -0,0 +1,210 @@
+package network
+
+// Inventory announcements.
+//
+// Instead of pushing full blocks or records to every peer, a node announces the hashes
+// of the items it has with an INV message and peers request only the ones they are
+// missing with GETDATA:
+//
+//     INV <kind> <hash,hash,...>
+//     GETDATA <kind> <hash,hash,...>
+//
+// The items of each kind are provided by the owner of the network with AddInventory.
+// Every connection remembers which items its peer is known to have, because the peer
+// announced them, requested them or was sent them, and items are never announced to
+// a peer that already knows them. An item announced by several peers is only requested
+// from the first one, it is only requested again if it is announced after CallTimeout
+// and it did not arrive. At most MaxRequestedItems requests are remembered, items
+// announced while there are more are requested without being remembered.
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// maximum number of hashes in a single INV or GETDATA message
+const MaxInventoryHashes = 1000
+
+// maximum number of items requested with GETDATA that are remembered
+const MaxRequestedItems = 10 * MaxInventoryHashes
+
+type Inv struct {
+	Kind   string
+	Hashes []string
+}
+
+func (msg *Inv) Type() string { return "INV" }
+
+func (msg *Inv) Encode(enc Encoder) {
+	enc.String(msg.Kind)
+	enc.Strings(msg.Hashes)
+}
+
+func (msg *Inv) Decode(dec Decoder) {
+	msg.Kind = dec.String()
+	msg.Hashes = dec.Strings()
+}
+
+type GetData struct {
+	Kind   string
+	Hashes []string
+}
+
+func (msg *GetData) Type() string { return "GETDATA" }
+
+func (msg *GetData) Encode(enc Encoder) {
+	enc.String(msg.Kind)
+	enc.Strings(msg.Hashes)
+}
+
+func (msg *GetData) Decode(dec Decoder) {
+	msg.Kind = dec.String()
+	msg.Hashes = dec.Strings()
+}
+
+func validateInventory(kind string, hashes []string) error {
+	if kind == "" || len(hashes) == 0 || len(hashes) > MaxInventoryHashes {
+		return errors.New("Invalid inventory fields")
+	}
+	return nil
+}
+
+func ValidateInv(msg Message) error {
+	inv := msg.(*Inv)
+	return validateInventory(inv.Kind, inv.Hashes)
+}
+
+func ValidateGetData(msg Message) error {
+	getData := msg.(*GetData)
+	return validateInventory(getData.Kind, getData.Hashes)
+}
+
+// the items of one kind that the current node has
+type Inventory struct {
+	Kind string
+	Has  func(hash string) bool            // whether the current node has the item
+	Get  func(hash string) (Message, bool) // the message that sends the item to a peer
+}
+
+func HandleInv(ctx *Context, msg Message) error {
+	// the other peer announced items it has
+	inv := msg.(*Inv)
+
+	inventory, ok := ctx.Network.GetInventory(inv.Kind)
+	if !ok {
+		return errors.New("Unknown inventory kind " + inv.Kind)
+	}
+	missing := []string{}
+	for _, hash := range inv.Hashes {
+		ctx.ConnInfo.Known.Add(inv.Kind + ":" + hash)
+		if !inventory.Has(hash) {
+			missing = append(missing, hash)
+		}
+	}
+	timeout := time.Duration(ctx.Network.Config.CallTimeout)
+	missing = ctx.Network.Inventories.request(inv.Kind, missing, timeout)
+	if len(missing) == 0 {
+		return nil
+	}
+	return ctx.Reply(&GetData{inv.Kind, missing})
+}
+
+func HandleGetData(ctx *Context, msg Message) error {
+	// the other peer requested items announced by the current node
+	getData := msg.(*GetData)
+
+	inventory, ok := ctx.Network.GetInventory(getData.Kind)
+	if !ok {
+		return errors.New("Unknown inventory kind " + getData.Kind)
+	}
+	for _, hash := range getData.Hashes {
+		item, ok := inventory.Get(hash)
+		if !ok {
+			continue
+		}
+		ctx.ConnInfo.Known.Add(getData.Kind + ":" + hash)
+		ctx.Reply(item)
+	}
+	return nil
+}
+
+// announces an item to every peer that does not know it yet
+func (network *Network) Announce(kind string, hash string) {
+	network.AnnounceExcept(kind, hash, nil)
+}
+
+// announces an item to every peer that does not know it yet, other than @except
+func (network *Network) AnnounceExcept(kind string, hash string, except *ConnInfo) {
+	if network.IsObserver() {
+		// observers never announce items, their peers would not accept them
+		return
+	}
+	network.ConnsLock.RLock()
+	for _, connInfo := range network.Conns {
+		if connInfo == except || !connInfo.Supports("INV") {
+			continue
+		}
+		if !connInfo.Known.Add(kind + ":" + hash) {
+			// already known by the peer
+			continue
+		}
+		connInfo.SendMessage(&Inv{kind, []string{hash}})
+	}
+	network.ConnsLock.RUnlock()
+}
+
+// records that the peer of the connection has an item, so it is not announced to it
+func (connInfo *ConnInfo) MarkKnown(kind string, hash string) {
+	connInfo.Known.Add(kind + ":" + hash)
+}
+
+func (connInfo *ConnInfo) Knows(kind string, hash string) bool {
+	return connInfo.Known.Has(kind + ":" + hash)
+}
+
+type inventories struct {
+	kinds map[string]Inventory
+	lock  sync.RWMutex
+
+	// map: kind:hash string => when the item was requested with GETDATA
+	requested map[string]time.Time
+}
+
+// records that the items @hashes of the kind @kind are requested, returns the ones that
+// were not requested less than @timeout ago
+func (inventories *inventories) request(kind string, hashes []string, timeout time.Duration) []string {
+	now := time.Now()
+	inventories.lock.Lock()
+	defer inventories.lock.Unlock()
+	for key, requested := range inventories.requested {
+		if now.Sub(requested) >= timeout {
+			delete(inventories.requested, key)
+		}
+	}
+	missing := []string{}
+	for _, hash := range hashes {
+		key := kind + ":" + hash
+		if _, ok := inventories.requested[key]; ok {
+			continue
+		}
+		if len(inventories.requested) < MaxRequestedItems {
+			inventories.requested[key] = now
+		}
+		missing = append(missing, hash)
+	}
+	return missing
+}
+
+func (network *Network) AddInventory(inventory Inventory) {
+	network.Inventories.lock.Lock()
+	network.Inventories.kinds[inventory.Kind] = inventory
+	network.Inventories.lock.Unlock()
+}
+
+func (network *Network) GetInventory(kind string) (Inventory, bool) {
+	network.Inventories.lock.RLock()
+	inventory, ok := network.Inventories.kinds[kind]
+	network.Inventories.lock.RUnlock()
+	return inventory, ok
+}
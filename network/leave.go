@@ -0,0 +1,96 @@
+package network
+
+// Leaving the network and shutting down a node.
+//
+// Shutdown stops accepting connections, sends LEAVE to every peer and closes all the
+// connections once their send queues are written. The loops of the connection manager
+// and of the heartbeats return, and the address book is saved once the goroutines
+// handling the connections are done.
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type Leave struct{}
+
+func (msg *Leave) Type() string       { return "LEAVE" }
+func (msg *Leave) Encode(enc Encoder) {}
+func (msg *Leave) Decode(dec Decoder) {}
+
+func HandleLeave(ctx *Context, msg Message) error {
+	// the peer is leaving the network, its connection is removed when it is closed
+	peerId, _ := ctx.ConnInfo.GetPeer()
+	fmt.Printf("Peer left: %s\n\n", peerId)
+	ctx.ConnInfo.Close()
+	return nil
+}
+
+// whether Shutdown was called
+func (network *Network) Closing() bool {
+	select {
+	case <-network.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// registers a goroutine handling a connection, unless the node is shutting down
+func (network *Network) startHandling() bool {
+	network.quitLock.Lock()
+	defer network.quitLock.Unlock()
+	if network.Closing() {
+		return false
+	}
+	network.handling.Add(1)
+	return true
+}
+
+var ErrClosing = errors.New("The node is shutting down")
+
+// leaves the network, it is safe to call it more than once
+func (network *Network) Shutdown() error {
+	network.quitLock.Lock()
+	if network.Closing() {
+		network.quitLock.Unlock()
+		return nil
+	}
+	close(network.quit)
+	network.quitLock.Unlock()
+
+	if network.Listener != nil {
+		network.Close()
+	}
+
+	network.ConnsLock.RLock()
+	conns := []*ConnInfo{}
+	for _, connInfo := range network.Conns {
+		conns = append(conns, connInfo)
+	}
+	network.ConnsLock.RUnlock()
+	// the messages already queued are written before LEAVE
+	flushing := sync.WaitGroup{}
+	for _, connInfo := range conns {
+		if connInfo.GetHello() != nil && connInfo.Supports("LEAVE") {
+			connInfo.SendMessage(&Leave{})
+		}
+		flushing.Add(1)
+		go func(connInfo *ConnInfo) {
+			connInfo.Flush(time.Duration(network.Config.WriteTimeout))
+			connInfo.Close()
+			flushing.Done()
+		}(connInfo)
+	}
+	flushing.Wait()
+
+	// the connections are removed by the goroutines handling them
+	network.handling.Wait()
+	err := network.BanList.Save()
+	if err != nil {
+		return err
+	}
+	return network.AddrBook.Save()
+}
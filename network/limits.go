@@ -0,0 +1,96 @@
+package network
+
+// Resource limits.
+//
+// The size of the messages read is limited by Config.MaxMessageSize. The number of
+// connections is limited by Config.MaxInboundConns and Config.MaxOutboundConns, in both
+// the full mesh and the gossip mode, and by Config.MaxConnsPerIP for the connections
+// accepted from the same IP.
+//
+// The messages of each type received from a peer are rate limited by a token bucket,
+// with the limits of Config.RateLimits or Config.DefaultRateLimit. Messages over the
+// limit are dropped and count as spam for the score of the peer, see ban.go.
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrTooManyConns = errors.New("Too many connections")
+
+type RateLimit struct {
+	Rate  float64 `json:"rate"`  // messages per second
+	Burst int     `json:"burst"` // messages accepted at once after a quiet period
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// the rate limit of the messages of type @messageType
+func (network *Network) RateLimit(messageType string) RateLimit {
+	if limit, ok := network.Config.RateLimits[messageType]; ok {
+		return limit
+	}
+	return network.Config.DefaultRateLimit
+}
+
+// takes a token of the bucket of @messageType, returns false if there is none
+func (connInfo *ConnInfo) allow(messageType string, limit RateLimit) bool {
+	now := time.Now()
+	connInfo.Lock.Lock()
+	defer connInfo.Lock.Unlock()
+	if connInfo.buckets == nil {
+		connInfo.buckets = map[string]*tokenBucket{}
+	}
+	bucket, ok := connInfo.buckets[messageType]
+	if !ok {
+		bucket = &tokenBucket{float64(limit.Burst), now}
+		connInfo.buckets[messageType] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * limit.Rate
+	if bucket.tokens > float64(limit.Burst) {
+		bucket.tokens = float64(limit.Burst)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// checks the rate limit of the type of @msg for the peer that sent it
+func (network *Network) checkRateLimit(ctx *Context, msg Message) error {
+	messageType := msg.Type()
+	if ctx.ConnInfo.allow(messageType, network.RateLimit(messageType)) {
+		return nil
+	}
+	errorMessage := fmt.Sprintf("Rate limit of %s messages exceeded", messageType)
+	ctx.Misbehave(ScoreSpam, errorMessage)
+	return errors.New(errorMessage)
+}
+
+// whether a connection from @ip can be accepted
+func (network *Network) AcceptsConn(ip string) bool {
+	_, inbound := network.CountConns()
+	if inbound >= network.Config.MaxInboundConns {
+		return false
+	}
+	return ip == "" || network.CountConnsFrom(ip) < network.Config.MaxConnsPerIP
+}
+
+// number of connections accepted from @ip
+func (network *Network) CountConnsFrom(ip string) int {
+	count := 0
+	network.ConnsLock.RLock()
+	for _, connInfo := range network.Conns {
+		if !connInfo.Outbound && RemoteIP(connInfo.Conn) == ip {
+			count++
+		}
+	}
+	network.ConnsLock.RUnlock()
+	return count
+}
@@ -0,0 +1,489 @@
+package network
+
+// Typed messages and the two wire formats used to transport them.
+//
+// The text format (protocol version 1) is a line of space separated fields:
+//
+//     <type> <field> <field> ...\n
+//
+// The binary format (protocol version 2) is a length-prefixed frame:
+//
+//     magic    1 byte              FrameMagic
+//     typeLen  1 byte              length of the message type
+//     type     typeLen bytes
+//     length   4 bytes big-endian  length of the payload
+//     payload  length bytes
+//     checksum 4 bytes big-endian  CRC-32 of type and payload
+//
+// Text messages always start with a letter, so the reader distinguishes the two formats
+// by the first byte. HELLO is always sent in text, the binary format is only used
+// after both peers advertised version BinaryFramingVersion or above. Binary frames may
+// also be compressed, see compress.go.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	BinaryFramingVersion = 2
+	FrameMagic           = 0xCE
+	MaxPayloadSize       = 16 * 1024 * 1024
+)
+
+// the connection can't be used after it, since the rest of the message was not read
+var ErrMessageTooLarge = errors.New("Message too large")
+
+type Message interface {
+	Type() string
+	Encode(enc Encoder)
+	Decode(dec Decoder)
+}
+
+// fields are written and read in the same order by Encode and Decode
+type Encoder interface {
+	String(s string)
+	Int(i int64)
+	Bytes(b []byte)
+	Strings(s []string)
+}
+
+// a Decoder records the first error found, which is returned by Err
+type Decoder interface {
+	String() string
+	Int() int64
+	Bytes() []byte
+	Strings() []string
+	Fail(err error) // records an error found by the message while decoding a field
+	Err() error
+}
+
+// a message that was read entirely but whose fields could not be decoded, the
+// connection stays usable after it
+type MalformedMessageError struct {
+	MessageType string
+	Err         error
+}
+
+func (err *MalformedMessageError) Error() string {
+	return fmt.Sprintf("Malformed %s message: %s", err.MessageType, err.Err)
+}
+
+// message of a type that has not been registered, only the type is known
+type UnknownMessage struct {
+	MessageType string
+}
+
+func (msg *UnknownMessage) Type() string       { return msg.MessageType }
+func (msg *UnknownMessage) Encode(enc Encoder) {}
+func (msg *UnknownMessage) Decode(dec Decoder) {}
+
+// text format
+
+type textEncoder struct {
+	args []string
+}
+
+func (enc *textEncoder) String(s string) {
+	enc.args = append(enc.args, s)
+}
+
+func (enc *textEncoder) Int(i int64) {
+	enc.args = append(enc.args, strconv.FormatInt(i, 10))
+}
+
+func (enc *textEncoder) Bytes(b []byte) {
+	if len(b) == 0 {
+		enc.args = append(enc.args, "-")
+	} else {
+		enc.args = append(enc.args, hex.EncodeToString(b))
+	}
+}
+
+func (enc *textEncoder) Strings(s []string) {
+	if len(s) == 0 {
+		enc.args = append(enc.args, "-")
+	} else {
+		enc.args = append(enc.args, strings.Join(s, ","))
+	}
+}
+
+type textDecoder struct {
+	args []string
+	err  error
+}
+
+func (dec *textDecoder) next() string {
+	if dec.err != nil {
+		return ""
+	}
+	if len(dec.args) == 0 {
+		dec.err = errors.New("Missing message field")
+		return ""
+	}
+	arg := dec.args[0]
+	dec.args = dec.args[1:]
+	return arg
+}
+
+func (dec *textDecoder) String() string {
+	return dec.next()
+}
+
+func (dec *textDecoder) Int() int64 {
+	arg := dec.next()
+	if dec.err != nil {
+		return 0
+	}
+	i, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		dec.err = err
+	}
+	return i
+}
+
+func (dec *textDecoder) Bytes() []byte {
+	arg := dec.next()
+	if dec.err != nil || arg == "-" {
+		return []byte{}
+	}
+	b, err := hex.DecodeString(arg)
+	if err != nil {
+		dec.err = err
+	}
+	return b
+}
+
+func (dec *textDecoder) Strings() []string {
+	arg := dec.next()
+	if dec.err != nil || arg == "-" {
+		return []string{}
+	}
+	return strings.Split(arg, ",")
+}
+
+func (dec *textDecoder) Fail(err error) {
+	if dec.err == nil {
+		dec.err = err
+	}
+}
+
+func (dec *textDecoder) Err() error {
+	return dec.err
+}
+
+// checks that all the fields were decoded
+func (dec *textDecoder) finish() error {
+	if dec.err == nil && len(dec.args) > 0 {
+		return errors.New("Unexpected message field")
+	}
+	return dec.err
+}
+
+// returns the fields of @msg in the text format, without the message type
+func TextArgs(msg Message) []string {
+	enc := textEncoder{}
+	msg.Encode(&enc)
+	return enc.args
+}
+
+// binary format
+
+type binaryEncoder struct {
+	buffer bytes.Buffer
+}
+
+func (enc *binaryEncoder) uvarint(u uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	enc.buffer.Write(buf[:binary.PutUvarint(buf, u)])
+}
+
+func (enc *binaryEncoder) String(s string) {
+	enc.uvarint(uint64(len(s)))
+	enc.buffer.WriteString(s)
+}
+
+func (enc *binaryEncoder) Int(i int64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	enc.buffer.Write(buf[:binary.PutVarint(buf, i)])
+}
+
+func (enc *binaryEncoder) Bytes(b []byte) {
+	enc.uvarint(uint64(len(b)))
+	enc.buffer.Write(b)
+}
+
+func (enc *binaryEncoder) Strings(s []string) {
+	enc.uvarint(uint64(len(s)))
+	for _, str := range s {
+		enc.String(str)
+	}
+}
+
+type binaryDecoder struct {
+	reader *bytes.Reader
+	err    error
+}
+
+func (dec *binaryDecoder) uvarint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	u, err := binary.ReadUvarint(dec.reader)
+	if err != nil {
+		dec.err = err
+	}
+	return u
+}
+
+func (dec *binaryDecoder) raw() []byte {
+	n := dec.uvarint()
+	if dec.err != nil {
+		return []byte{}
+	}
+	if n > uint64(dec.reader.Len()) {
+		dec.err = errors.New("Message field exceeds payload")
+		return []byte{}
+	}
+	b := make([]byte, n)
+	dec.reader.Read(b)
+	return b
+}
+
+func (dec *binaryDecoder) String() string {
+	return string(dec.raw())
+}
+
+func (dec *binaryDecoder) Int() int64 {
+	if dec.err != nil {
+		return 0
+	}
+	i, err := binary.ReadVarint(dec.reader)
+	if err != nil {
+		dec.err = err
+	}
+	return i
+}
+
+func (dec *binaryDecoder) Bytes() []byte {
+	return dec.raw()
+}
+
+func (dec *binaryDecoder) Strings() []string {
+	n := dec.uvarint()
+	if n > uint64(dec.reader.Len()) {
+		dec.err = errors.New("Message field exceeds payload")
+	}
+	s := []string{}
+	for i := uint64(0); i < n && dec.err == nil; i++ {
+		s = append(s, dec.String())
+	}
+	return s
+}
+
+func (dec *binaryDecoder) Fail(err error) {
+	if dec.err == nil {
+		dec.err = err
+	}
+}
+
+func (dec *binaryDecoder) Err() error {
+	return dec.err
+}
+
+// checks that all the fields were decoded
+func (dec *binaryDecoder) finish() error {
+	if dec.err == nil && dec.reader.Len() > 0 {
+		return errors.New("Unexpected message field")
+	}
+	return dec.err
+}
+
+// encoding and decoding of whole messages
+
+func EncodeText(msg Message) []byte {
+	args := append([]string{msg.Type()}, TextArgs(msg)...)
+	return []byte(strings.Join(args, " ") + "\n")
+}
+
+func EncodeBinary(msg Message) ([]byte, error) {
+	messageType, payload, err := encodePayload(msg)
+	if err != nil {
+		return nil, err
+	}
+	return binaryFrame(messageType, payload), nil
+}
+
+// the fields of @msg in the binary format
+func encodePayload(msg Message) (string, []byte, error) {
+	messageType := msg.Type()
+	if len(messageType) > 255 {
+		return "", nil, errors.New("Message type too long")
+	}
+	enc := binaryEncoder{}
+	msg.Encode(&enc)
+	payload := enc.buffer.Bytes()
+	if len(payload) > MaxPayloadSize {
+		return "", nil, errors.New("Message payload too large")
+	}
+	return messageType, payload, nil
+}
+
+func binaryFrame(messageType string, payload []byte) []byte {
+	frame := bytes.Buffer{}
+	frame.WriteByte(FrameMagic)
+	frame.WriteByte(byte(len(messageType)))
+	frame.WriteString(messageType)
+	binary.Write(&frame, binary.BigEndian, uint32(len(payload)))
+	frame.Write(payload)
+	binary.Write(&frame, binary.BigEndian, checksum(messageType, payload))
+	return frame.Bytes()
+}
+
+func checksum(messageType string, payload []byte) uint32 {
+	crc := crc32.ChecksumIEEE([]byte(messageType))
+	return crc32.Update(crc, crc32.IEEETable, payload)
+}
+
+// writes @msg to @w in a single call, in the binary format if @binaryFraming is set
+func WriteMessage(w io.Writer, msg Message, binaryFraming bool) error {
+	var data []byte
+	var err error
+	if binaryFraming {
+		data, err = EncodeBinary(msg)
+		if err != nil {
+			return err
+		}
+	} else {
+		data = EncodeText(msg)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// reads the next message, in any of the two formats, using @newMessage to
+// create the typed message for a message type
+func ReadMessage(reader *bufio.Reader, newMessage func(messageType string) Message) (Message, error) {
+	return ReadMessageLimit(reader, MaxPayloadSize, newMessage)
+}
+
+// reads the next message like ReadMessage, failing with ErrMessageTooLarge if the text
+// line or the binary payload is longer than @maxSize bytes
+func ReadMessageLimit(reader *bufio.Reader, maxSize int, newMessage func(messageType string) Message) (Message, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == FrameMagic || first[0] == CompressedFrameMagic {
+		return readBinary(reader, maxSize, newMessage)
+	}
+	return readText(reader, maxSize, newMessage)
+}
+
+// reads up to the next newline without buffering more than @maxSize bytes
+func readLine(reader *bufio.Reader, maxSize int) (string, error) {
+	line := []byte{}
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxSize {
+			return "", ErrMessageTooLarge
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(line), nil
+	}
+}
+
+func readText(reader *bufio.Reader, maxSize int, newMessage func(messageType string) Message) (Message, error) {
+	line, err := readLine(reader, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	args := strings.Split(strings.TrimSpace(line), " ")
+	msg := newMessage(args[0])
+	if _, ok := msg.(*UnknownMessage); ok {
+		return msg, nil
+	}
+	dec := textDecoder{args[1:], nil}
+	msg.Decode(&dec)
+	if err := dec.finish(); err != nil {
+		return nil, &MalformedMessageError{args[0], err}
+	}
+	return msg, nil
+}
+
+func readBinary(reader *bufio.Reader, maxSize int, newMessage func(messageType string) Message) (Message, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	typeBytes := make([]byte, header[1])
+	_, err = io.ReadFull(reader, typeBytes)
+	if err != nil {
+		return nil, err
+	}
+	var length uint32
+	err = binary.Read(reader, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	if length > MaxPayloadSize || int64(length) > int64(maxSize) {
+		return nil, ErrMessageTooLarge
+	}
+	compressed := header[0] == CompressedFrameMagic
+	var rawLength uint32
+	if compressed {
+		err = binary.Read(reader, binary.BigEndian, &rawLength)
+		if err != nil {
+			return nil, err
+		}
+		if rawLength > MaxPayloadSize || int64(rawLength) > int64(maxSize) {
+			return nil, ErrMessageTooLarge
+		}
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, err
+	}
+	var crc uint32
+	err = binary.Read(reader, binary.BigEndian, &crc)
+	if err != nil {
+		return nil, err
+	}
+	messageType := string(typeBytes)
+	if crc != checksum(messageType, payload) {
+		return nil, errors.New("Message checksum mismatch")
+	}
+	if compressed {
+		payload, err = decompress(payload, int(rawLength))
+		if err != nil {
+			return nil, &MalformedMessageError{messageType, err}
+		}
+	}
+
+	msg := newMessage(messageType)
+	if _, ok := msg.(*UnknownMessage); ok {
+		return msg, nil
+	}
+	dec := binaryDecoder{bytes.NewReader(payload), nil}
+	msg.Decode(&dec)
+	if err := dec.finish(); err != nil {
+		return nil, &MalformedMessageError{messageType, err}
+	}
+	return msg, nil
+}
@@ -0,0 +1,186 @@
+package network
+
+// Messages handled by the network itself
+
+import (
+	"errors"
+)
+
+type PeerRequest struct {
+	PeerId   string
+	PeerAddr string
+}
+
+func (msg *PeerRequest) Type() string { return "PEER-REQUEST" }
+
+func (msg *PeerRequest) Encode(enc Encoder) {
+	enc.String(msg.PeerId)
+	enc.String(msg.PeerAddr)
+}
+
+func (msg *PeerRequest) Decode(dec Decoder) {
+	msg.PeerId = dec.String()
+	msg.PeerAddr = dec.String()
+}
+
+type PeerAccepted struct {
+	PeerId   string
+	PeerAddr string
+}
+
+func (msg *PeerAccepted) Type() string { return "PEER-ACCEPTED" }
+
+func (msg *PeerAccepted) Encode(enc Encoder) {
+	enc.String(msg.PeerId)
+	enc.String(msg.PeerAddr)
+}
+
+func (msg *PeerAccepted) Decode(dec Decoder) {
+	msg.PeerId = dec.String()
+	msg.PeerAddr = dec.String()
+}
+
+type PeerList struct{}
+
+func (msg *PeerList) Type() string       { return "PEER-LIST" }
+func (msg *PeerList) Encode(enc Encoder) {}
+func (msg *PeerList) Decode(dec Decoder) {}
+
+type PeerAdd struct {
+	PeerId   string
+	PeerAddr string
+}
+
+func (msg *PeerAdd) Type() string { return "PEER-ADD" }
+
+func (msg *PeerAdd) Encode(enc Encoder) {
+	enc.String(msg.PeerId)
+	enc.String(msg.PeerAddr)
+}
+
+func (msg *PeerAdd) Decode(dec Decoder) {
+	msg.PeerId = dec.String()
+	msg.PeerAddr = dec.String()
+}
+
+// handlers of the builtin messages
+
+func ValidatePeerRequest(msg Message) error {
+	peerRequest := msg.(*PeerRequest)
+	return validatePeer(peerRequest.PeerId, peerRequest.PeerAddr)
+}
+
+func HandlePeerRequest(ctx *Context, msg Message) error {
+	// the other peer is requesting the current network to add it as peer
+	peerRequest := msg.(*PeerRequest)
+	network, connInfo := ctx.Network, ctx.ConnInfo
+
+	connInfo.SetPeer(peerRequest.PeerId, peerRequest.PeerAddr)
+
+	if peerRequest.PeerId == network.NodeId {
+		connInfo.Close()
+		return errors.New("Can't add itself as peer")
+	}
+	if network.BanList.IsBanned(peerRequest.PeerId) {
+		connInfo.Close()
+		return errors.New("Requesting peer is banned")
+	}
+	if !network.AcceptsInbound() {
+		connInfo.Close()
+		return errors.New("Too many inbound peers")
+	}
+
+	// accept requesting peer as peer
+	if !network.AddPeer(connInfo) {
+		connInfo.Close()
+		return errors.New("Requesting peer is already a peer")
+	}
+	ctx.Reply(&PeerAccepted{network.NodeId, network.NodeAddr})
+	return connInfo.SendMessage(network.Hello())
+}
+
+func ValidatePeerAccepted(msg Message) error {
+	peerAccepted := msg.(*PeerAccepted)
+	return validatePeer(peerAccepted.PeerId, peerAccepted.PeerAddr)
+}
+
+func HandlePeerAccepted(ctx *Context, msg Message) error {
+	// the other peer accepted the current network as a peer
+	peerAccepted := msg.(*PeerAccepted)
+	network, connInfo := ctx.Network, ctx.ConnInfo
+
+	connInfo.SetPeer(peerAccepted.PeerId, peerAccepted.PeerAddr)
+
+	if peerAccepted.PeerId == network.NodeId {
+		connInfo.Close()
+		return errors.New("Can't add itself as peer")
+	}
+	if network.BanList.IsBanned(peerAccepted.PeerId) {
+		connInfo.Close()
+		return errors.New("Accepting peer is banned")
+	}
+
+	// add accepting peer as peer
+	if !network.AddPeer(connInfo) {
+		connInfo.Close()
+		return errors.New("Accepting peer is already a peer")
+	}
+	return nil
+}
+
+func HandlePeerList(ctx *Context, msg Message) error {
+	// the other peer is requesting a list of all the other peers of the current network
+	network, connInfo := ctx.Network, ctx.ConnInfo
+
+	if !connInfo.Supports("PEER-ADD") {
+		return errors.New("Peer does not support PEER-ADD")
+	}
+	if !network.authorized(connInfo) {
+		return errors.New("Peer is not authorized to list the peers")
+	}
+
+	peerId, _ := connInfo.GetPeer()
+	network.PeersLock.RLock()
+	for _, peer := range network.Peers {
+		if peer.Id == peerId {
+			continue
+		}
+		ctx.Reply(&PeerAdd{peer.Id, peer.Addr})
+	}
+	network.PeersLock.RUnlock()
+	return nil
+}
+
+func ValidatePeerAdd(msg Message) error {
+	peerAdd := msg.(*PeerAdd)
+	return validatePeer(peerAdd.PeerId, peerAdd.PeerAddr)
+}
+
+func HandlePeerAdd(ctx *Context, msg Message) error {
+	// the other peer sent information about one of his peers, as requested by
+	// the current network with the PEER-LIST message
+	peerAdd := msg.(*PeerAdd)
+	network := ctx.Network
+
+	if peerAdd.PeerId == network.NodeId {
+		return errors.New("Can't add itself as peer")
+	}
+	_, ok := network.GetPeer(peerAdd.PeerId)
+	if ok {
+		return errors.New("Requesting peer is already a peer")
+	}
+	source, _ := ctx.ConnInfo.GetPeer()
+	network.AddrBook.Add(peerAdd.PeerAddr, peerAdd.PeerId, source)
+	if network.IsBanned(peerAdd.PeerId, peerAdd.PeerAddr) {
+		return nil
+	}
+	if !network.WantsOutbound() {
+		// in gossip mode the current node already has enough peers
+		return nil
+	}
+
+	// dialing may take up to Config.DialTimeout, so it does not block the connection
+	// the message was received from
+	network.DialInBackground(peerAdd.PeerAddr)
+	return nil
+}
@@ -0,0 +1,70 @@
+package network
+
+// Middlewares wrap the dispatch of every received message to its handler, so that
+// concerns like logging, rate limits, authorization or metrics are handled in one place.
+//
+// A middleware receives the next handler of the chain and returns a handler that may:
+//   - drop the message, by returning without calling next
+//   - annotate the message for the following handlers, with ctx.Set
+//   - disconnect the peer, with ctx.Disconnect
+//
+// Middlewares are called in the order they were added with Use, the first one added
+// being the outermost. The innermost handler checks the handshake, validates the
+// message and calls the handler registered for its type. The messages wrapped in a
+// CALL or a GOSSIP go through the whole chain again, after their wrapper.
+
+import (
+	"fmt"
+)
+
+type Middleware func(next Handler) Handler
+
+func (network *Network) Use(middleware Middleware) {
+	network.MiddlewaresLock.Lock()
+	network.Middlewares = append(network.Middlewares, middleware)
+	network.MiddlewaresLock.Unlock()
+}
+
+// the handler that wraps dispatch with all the middlewares
+func (network *Network) chain() Handler {
+	handler := Handler(network.dispatch)
+	network.MiddlewaresLock.RLock()
+	for i := len(network.Middlewares) - 1; i >= 0; i-- {
+		handler = network.Middlewares[i](handler)
+	}
+	network.MiddlewaresLock.RUnlock()
+	return handler
+}
+
+// stores an annotation about the message being handled
+func (ctx *Context) Set(key string, value interface{}) {
+	if ctx.Values == nil {
+		ctx.Values = map[string]interface{}{}
+	}
+	ctx.Values[key] = value
+}
+
+func (ctx *Context) Get(key string) (interface{}, bool) {
+	value, ok := ctx.Values[key]
+	return value, ok
+}
+
+// closes the connection with the peer, no more messages will be read from it
+func (ctx *Context) Disconnect(reason string) {
+	peerId, _ := ctx.ConnInfo.GetPeer()
+	fmt.Printf("Disconnecting %s: %s\n\n", peerId, reason)
+	ctx.ConnInfo.Close()
+}
+
+// prints every received message
+func LoggingMiddleware(next Handler) Handler {
+	return func(ctx *Context, msg Message) error {
+		peerId, _ := ctx.ConnInfo.GetPeer()
+		fmt.Printf("Received %s from %s\n", msg.Type(), peerId)
+		err := next(ctx, msg)
+		if err != nil {
+			fmt.Printf("Failed %s from %s: %s\n", msg.Type(), peerId, err)
+		}
+		return err
+	}
+}
@@ -1,15 +1,16 @@
 package network
 
 // Implementation of a network of symmetrical peers that can start, join or leave a network.
-// The network is designed to be fully connected, that is, all peer connected to each other.
+// By default the network is fully connected, that is, all peer connected to each other.
+// In gossip mode each peer only connects to a few others, see gossip.go.
 
 import (
 	"fmt"
 	"net"
 	"bufio"
-	"strings"
 	"sync"
 	"errors"
+	"time"
 )
 
 type Peer struct {
@@ -23,26 +24,53 @@ type ConnInfo struct {
 	PeerAddr   string        // the empty string is used when the peerAddr has not been resolved yet
 	Conn       net.Conn
 	Reader     *bufio.Reader
+	Hello      *Hello        // nil until the HELLO of the peer is received
+	Outbound   bool          // whether the current node dialed the connection
+	DialAddr   string        // address dialed by the current node, empty for accepted connections
+	Known      *SeenCache    // inventory items the peer is known to have, see inventory.go
+	RTT        time.Duration // round trip time measured by the last PING, see heartbeat.go
+	Score      int           // misbehaviour score of the peer, see ban.go
+
+	// map: messageType string => rate limit of the messages received, see limits.go
+	buckets map[string]*tokenBucket
+
+	// topics the peer is subscribed to, see pubsub.go
+	topics map[string]bool
+
+	// traffic statistics, see stats.go
+	stats   connStats
+	counter *countingReader
+	Lock       sync.RWMutex  // protects the fields written after the connection is registered
+
+	// outbound queue, see queue.go
+	WriteTimeout time.Duration
+	QueuePolicy  string
+
+	CompressionThreshold int // see compress.go
+	queue        chan outgoing
+	done         chan struct{} // closed when the connection is closed
+	closeOnce    sync.Once
+
+	pingNonce   int64 // nonce of the PING waiting for a PONG, 0 if none
+	pingSent    time.Time
+	missedPings int
 }
 
-func (connInfo *ConnInfo) SendMessage(message string) error {
-	_, err := fmt.Fprint(connInfo.Conn, message)
-	return err
-}
-
-func (network *Network) SendMessage(peerId string, message string) error {
-	peer, ok := network.GetPeer(peerId)
+func (network *Network) SendMessage(peerId string, msg Message) error {
+	connInfo, ok := network.GetPeerConn(peerId)
 	if !ok {
 		return errors.New("Peer not found")
 	}
-	_, err := fmt.Fprint(peer.Conn, message)
-	return err
+	return connInfo.SendMessage(msg)
 }
 
-func (network *Network) Broadcast(message string) {
+func (network *Network) Broadcast(msg Message) {
 	network.ConnsLock.RLock()
 	for _, connInfo := range network.Conns {
-		fmt.Fprintf(connInfo.Conn, message)
+		if !connInfo.Supports(msg.Type()) {
+			continue
+		}
+		connInfo.SendMessage(msg)
 	}
 	network.ConnsLock.RUnlock()
 }
@@ -51,6 +79,8 @@ type Network struct {
 	NodeId    string
 	NodeAddr  string
 	Listener  net.Listener
+	Config    Config
+	Transport Transport // selected by Config.Transport, see transport.go
 
 	// map: peerId string => peer Peer
 	Peers     map[string]Peer
@@ -60,10 +90,56 @@ type Network struct {
 	Conns     map[net.Conn]*ConnInfo
 	ConnsLock sync.RWMutex
 
-	// map: messageType string => handler func
-	Handlers     map[string]func(connInfo *ConnInfo, args []string)
+	// map: messageType string => definition of the message type and its handler
+	Handlers     map[string]*MessageDef
 	HandlersLock sync.RWMutex
 
+	// map: messageType string => dropped when sent by observers, see observer.go.
+	// Protected by HandlersLock
+	ObserverDenied map[string]bool
+
+	// wrap the dispatch of every message, see middleware.go
+	Middlewares     []Middleware
+	MiddlewaresLock sync.RWMutex
+
+	// map: requestId int64 => call waiting for a reply, see rpc.go
+	Calls         map[int64]pendingCall
+	CallsLock     sync.Mutex
+	lastRequestId int64
+
+	// ids of the gossiped messages already received, see gossip.go
+	Seen *SeenCache
+
+	// map: kind string => items of the kind the current node has, see inventory.go
+	Inventories inventories
+
+	// topics the current node is subscribed to, see pubsub.go
+	Subscriptions subscriptions
+
+	// known peer addresses, used by the connection manager, see connmgr.go
+	AddrBook *AddrBook
+
+	// number of addresses being dialed in the background, see connmgr.go
+	dialing int32
+
+	// peers that are not accepted nor dialed, see ban.go
+	BanList *BanList
+
+	// returns the chainId and height sent in the HELLO message, set by the owner of the network
+	ChainInfo func() (chainId string, height int64)
+
+	// called when the handshake with a peer is completed, may be nil
+	OnHandshake func(connInfo *ConnInfo)
+
+	// returns whether the peer may learn the peers, addresses and subscriptions of the
+	// current node, every peer may when nil
+	Authorized func(connInfo *ConnInfo) bool
+
+	// closed by Shutdown, see leave.go
+	quit     chan struct{}
+	quitLock sync.Mutex     // orders the start of handling a connection and Shutdown
+	handling sync.WaitGroup // goroutines handling connections
+
 	// the native map implementation in Go is not thread-safe.
 	// we may use multiple goroutines that are able to access and modify the same maps concurrently,
 	// so we need locks for synchronization
@@ -72,16 +148,43 @@ type Network struct {
 func NewNode(nodeId string) *Network {
 	network := Network{}
 	network.NodeId    = nodeId
+	network.Config    = DefaultConfig()
+	network.Transport = Transports[network.Config.Transport]
 	network.Peers     = map[string]Peer{}
 	network.PeersLock = sync.RWMutex{}
 	network.Conns     = map[net.Conn]*ConnInfo{}
 	network.ConnsLock = sync.RWMutex{}
-	network.Handlers  = map[string]func(connInfo *ConnInfo, args []string){}
+	network.Handlers  = map[string]*MessageDef{}
+	// observers never announce items, see observer.go
+	network.ObserverDenied = map[string]bool{"INV": true}
+	network.AddHandler(MessageDef{func() Message { return &PeerRequest{} }, ValidatePeerRequest, HandlePeerRequest})
+	network.AddHandler(MessageDef{func() Message { return &PeerAccepted{} }, ValidatePeerAccepted, HandlePeerAccepted})
+	network.AddHandler(MessageDef{func() Message { return &Hello{} }, ValidateHello, HandleHello})
+	network.AddHandler(MessageDef{func() Message { return &PeerList{} }, nil, HandlePeerList})
+	network.AddHandler(MessageDef{func() Message { return &PeerAdd{} }, ValidatePeerAdd, HandlePeerAdd})
+	network.AddHandler(MessageDef{func() Message { return &Call{newMessage: network.NewMessage} }, ValidateCall, HandleCall})
+	network.AddHandler(MessageDef{func() Message { return &Reply{newMessage: network.NewMessage} }, nil, HandleReply})
+	network.AddHandler(MessageDef{func() Message { return &Gossip{newMessage: network.NewMessage} }, ValidateGossip, HandleGossip})
+	network.AddHandler(MessageDef{func() Message { return &Ping{} }, nil, HandlePing})
+	network.AddHandler(MessageDef{func() Message { return &Pong{} }, nil, HandlePong})
+	network.AddHandler(MessageDef{func() Message { return &Leave{} }, nil, HandleLeave})
+	network.AddHandler(MessageDef{func() Message { return &Addr{} }, ValidateAddr, HandleAddr})
+	network.AddHandler(MessageDef{func() Message { return &Subscriptions{} }, ValidateSubscriptions, HandleSubscriptions})
+	network.AddHandler(MessageDef{func() Message { return &Publish{} }, ValidatePublish, HandlePublish})
+	network.AddHandler(MessageDef{func() Message { return &Inv{} }, ValidateInv, HandleInv})
+	network.AddHandler(MessageDef{func() Message { return &GetData{} }, ValidateGetData, HandleGetData})
+	network.Inventories = inventories{kinds: map[string]Inventory{}, requested: map[string]time.Time{}}
+	network.Calls = map[int64]pendingCall{}
+	network.Subscriptions = subscriptions{topics: map[string][]*Subscription{}}
+	network.Seen = NewSeenCache(network.Config.SeenCacheSize)
+	network.AddrBook, _ = LoadAddrBook("")
+	network.BanList, _ = LoadBanList("")
+	network.quit = make(chan struct{})
 	return &network
 }
 
 func (network *Network) Listen() error {
-	listener, err := net.Listen("tcp", ":0")
+	listener, err := network.Transport.Listen(network.Config.ListenAddr)
 	if err != nil {
 		return err
 	}
@@ -93,17 +196,48 @@ func (network *Network) Listen() error {
 func (network *Network) Start() error {
 	for {
 		conn, err := network.AcceptConnection()
+		if network.Closing() {
+			if err == nil {
+				conn.Close()
+			}
+			return nil
+		}
 		if err != nil {
 			return err
 		}
+		if network.BanList.IsBanned(RemoteIP(conn)) || !network.AcceptsConn(RemoteIP(conn)) {
+			conn.Close()
+			continue
+		}
 		go network.StartHandleConnection(conn)
 	}
 }
 
 func (network *Network) StartHandleConnection(conn net.Conn) {
+	if !network.startHandling() {
+		if connInfo, ok := network.GetConn(conn); ok {
+			connInfo.Close()
+		} else {
+			conn.Close()
+		}
+		network.DeleteConn(conn)
+		return
+	}
+	defer network.handling.Done()
 	connInfo := network.HandleConnection(conn)
 	for {
+		// a peer that stays silent for too long is considered dead. Peers that don't
+		// send heartbeats may stay silent after the handshake
+		if connInfo.GetHello() == nil || connInfo.Supports("PING") {
+			conn.SetReadDeadline(time.Now().Add(network.ReadTimeout()))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
 		msg, err := network.ReadNextMessage(connInfo)
+		if _, ok := err.(*MalformedMessageError); ok {
+			network.Misbehave(connInfo, ScoreMalformed, err.Error())
+			continue
+		}
 		if err != nil {
 			break
 		}
@@ -115,7 +249,17 @@ func (network *Network) StartHandleConnection(conn net.Conn) {
 			go network.StartHandleConnection(newConn)
 		}
 	}
-	network.DeletePeer(connInfo.PeerId)
+	network.failCalls(connInfo)
+	peerId, _ := connInfo.GetPeer()
+	if _, ok := network.GetPeer(peerId); !ok && connInfo.DialAddr != "" &&
+		connInfo.GetHello() == nil && !network.Closing() {
+		// the peer closed the connection or was rejected during the handshake, and
+		// it is not connected through another connection
+		network.AddrBook.MarkFailed(connInfo.DialAddr,
+			time.Duration(network.Config.BackoffMin), time.Duration(network.Config.BackoffMax))
+	}
+	connInfo.Close()
+	network.DeletePeer(peerId, connInfo.Conn)
 	network.DeleteConn(connInfo.Conn)
 }
 
@@ -128,135 +272,158 @@ func (network *Network) Close() error {
 }
 
 // may return a new connection that must be handled
-func (network *Network) HandleMessage(connInfo *ConnInfo, message string) (net.Conn, error) {
+func (network *Network) HandleMessage(connInfo *ConnInfo, msg Message) (net.Conn, error) {
 	// received message
-	message = strings.TrimSpace(message)
-	args := strings.Split(message, " ")
+	ctx := Context{Network: network, ConnInfo: connInfo}
+	err := network.chain()(&ctx, msg)
+	return ctx.NewConn, err
+}
+
+// calls the handler registered for the type of the message, after all the middlewares
+func (network *Network) dispatch(ctx *Context, msg Message) error {
+	messageType := msg.Type()
 
-	if len(args) == 0 {
-		return nil, errors.New("Empty message")
+	if ctx.ConnInfo.GetHello() == nil && !ctx.ConnInfo.Supports(messageType) {
+		errorMessage := fmt.Sprintf("The message type %s was sent before the handshake", messageType)
+		ctx.Misbehave(ScoreSpam, errorMessage)
+		return errors.New(errorMessage)
 	}
 
-	messageType := args[0]
+	err := network.checkRateLimit(ctx, msg)
+	if err != nil {
+		return err
+	}
 
-	if len(args) == 3 && messageType == "PEER-REQUEST" {
-		// the other peer is requesting the current network to add it as peer
+	err = network.checkObserver(ctx, msg)
+	if err != nil {
+		return err
+	}
 
-		connInfo.PeerId = args[1]
-		connInfo.PeerAddr = args[2]
+	def, err := network.validate(ctx, msg)
+	if err != nil {
+		return err
+	}
 
-		if connInfo.PeerId == network.NodeId {
-			connInfo.Conn.Close()
-			return nil, errors.New("Can't add itself as peer")
-		} else {
-			_, ok := network.GetPeer(connInfo.PeerId)
-			if ok {
-				connInfo.Conn.Close()
-				return nil, errors.New("Requesting peer is already a peer")
-			} else {
-				// accept requesting peer as peer
-				network.SetPeer(connInfo.PeerId, Peer{connInfo.PeerId, connInfo.PeerAddr, connInfo.Conn})
-				fmt.Fprintf(connInfo.Conn, "PEER-ACCEPTED %s %s\n", network.NodeId, network.NodeAddr)
-				return nil, nil
-			}
-		}
-	} else if len(args) == 3 && messageType == "PEER-ACCEPTED" {
-		// the other peer accepted the current network as a peer
-		
-		connInfo.PeerId = args[1]
-		connInfo.PeerAddr = args[2]
-
-		if connInfo.PeerId == network.NodeId {
-			connInfo.Conn.Close()
-			return nil, errors.New("Can't add itself as peer")
-		} else {
-			_, ok := network.GetPeer(connInfo.PeerId)
-			if ok {
-				connInfo.Conn.Close()
-				return nil, errors.New("Requesting peer is already a peer")
-			} else {
-				// add accepting peer as peer
-				network.SetPeer(connInfo.PeerId, Peer{connInfo.PeerId, connInfo.PeerAddr, connInfo.Conn})
-				return nil, nil
-			}
-		}
-	} else if len(args) == 1 && messageType == "PEER-LIST" {
-		// the other peer is requesting a list of all the other peers of the current network
+	return def.Handle(ctx, msg)
+}
 
-		network.PeersLock.RLock()
-		for _, peer := range network.Peers {
-			if peer.Id == connInfo.PeerId {
-				continue
-			}
-			fmt.Fprintf(connInfo.Conn, "PEER-ADD %s %s\n", peer.Id, peer.Addr)
-		}
-		network.PeersLock.RUnlock()
-		return nil, nil
-
-	} else if len(args) == 3 && messageType == "PEER-ADD" {
-		// the other peer sent information about one of his peers, as requested by
-		// the current network with the PEER-LIST message
-		
-		peerId := args[1]
-		peerAddr := args[2]
-
-		if peerId == network.NodeId {
-			return nil, errors.New("Can't add itself as peer")
-		} else {
-			_, ok := network.GetPeer(peerId)
-			if ok {
-				return nil, errors.New("Requesting peer is already a peer")
-			} else {
-				conn, err := net.Dial("tcp", peerAddr)
-				if err != nil {
-					return nil, errors.New("Failed to connect to peer")
-				} else {
-					fmt.Fprintf(conn, "PEER-REQUEST %s %s\n", network.NodeId, network.NodeAddr)
-					return conn, nil
-				}
-			}
-		}
-	} else if handler, ok := network.GetHandler(messageType); ok {
-		handler(connInfo, args)
-	} else {
+// runs the validator registered for the type of the message, the peer misbehaves if the
+// type is unknown or the message is invalid
+func (network *Network) validate(ctx *Context, msg Message) (*MessageDef, error) {
+	messageType := msg.Type()
+	def, ok := network.GetHandler(messageType)
+	if !ok {
 		errorMessage := fmt.Sprintf("The message type %s is invalid", messageType)
+		ctx.Misbehave(ScoreUnknownType, errorMessage)
 		return nil, errors.New(errorMessage)
 	}
-	return nil, nil
+	if def.Validate != nil {
+		err := def.Validate(msg)
+		if err != nil {
+			err = fmt.Errorf("Invalid %s message: %s", messageType, err)
+			ctx.Misbehave(ScoreMalformed, err.Error())
+			return nil, err
+		}
+	}
+	return def, nil
 }
 
 // connections are handled concurrently to each other and stay open during the lifetime of the newtork
 func (network *Network) HandleConnection(conn net.Conn) *ConnInfo {
-	connInfo := ConnInfo{}
-	connInfo.Conn = conn
+	// connections dialed with Dial are already registered
+	if connInfo, ok := network.GetConn(conn); ok {
+		return connInfo
+	}
+
+	connInfo := network.newConnInfo(conn, "")
 
 	// add to a list of connections
-	network.SetConn(conn, &connInfo)
+	network.SetConn(conn, connInfo)
 
-	// the protocol of communication bewteen peers is in plain-text format,
-	// with newlines '\n' at the end of each message
-	connInfo.Reader = bufio.NewReader(conn)
+	return connInfo
+}
 
+// @dialAddr is the address dialed by the current node, empty for accepted connections
+func (network *Network) newConnInfo(conn net.Conn, dialAddr string) *ConnInfo {
+	connInfo := ConnInfo{}
+	connInfo.Conn = conn
+	connInfo.Outbound = dialAddr != ""
+	connInfo.DialAddr = dialAddr
+	connInfo.Known = NewSeenCache(network.Config.KnownInventorySize)
+	connInfo.WriteTimeout = time.Duration(network.Config.WriteTimeout)
+	connInfo.QueuePolicy = network.Config.SendQueuePolicy
+	connInfo.CompressionThreshold = network.Config.CompressionThreshold
+	connInfo.queue = make(chan outgoing, network.Config.SendQueueSize)
+	connInfo.done = make(chan struct{})
+
+	// the protocol of communication bewteen peers is either in plain-text format, with
+	// newlines '\n' at the end of each message, or in binary frames (see message.go)
+	connInfo.counter = &countingReader{reader: conn}
+	connInfo.Reader = bufio.NewReader(connInfo.counter)
+	connInfo.stats = newConnStats()
+
+	go connInfo.writeLoop()
 	return &connInfo
 }
 
-func (network *Network) ReadNextMessage(connInfo *ConnInfo) (string, error) {
-	line, err := connInfo.Reader.ReadString('\n')
+// reads the next message of the connection and records its size, see stats.go
+func (network *Network) ReadNextMessage(connInfo *ConnInfo) (Message, error) {
+	start := connInfo.bytesRead()
+	rawLength, compressed := peekRawLength(connInfo.Reader)
+	msg, err := ReadMessageLimit(connInfo.Reader, network.Config.MaxMessageSize, network.NewMessage)
+	size := int(connInfo.bytesRead() - start)
+	if malformed, ok := err.(*MalformedMessageError); ok {
+		connInfo.recordIn(malformed.MessageType, size, 0)
+	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return line, nil
+	if !compressed {
+		rawLength = 0
+	}
+	connInfo.recordIn(msg.Type(), size, rawLength)
+	return msg, nil
 }
 
 // may return a new connection that must be handled
 func (network *Network) JoinNetwork(peerAddr string) (net.Conn, error) {
 	// the current peer will request to join the network of the target peer
-	conn, err := net.Dial("tcp", peerAddr)
+	connInfo, err := network.dial(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	connInfo.SendMessage(&PeerList{})
+	return connInfo.Conn, nil
+}
+
+// connects to the peer at @peerAddr and requests to be added as its peer. The
+// connection is registered as outbound, but it still must be handled
+func (network *Network) Dial(peerAddr string) (net.Conn, error) {
+	connInfo, err := network.dial(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	return connInfo.Conn, nil
+}
+
+func (network *Network) dial(peerAddr string) (*ConnInfo, error) {
+	if network.Closing() {
+		return nil, ErrClosing
+	}
+	if outbound, _ := network.CountConns(); outbound >= network.Config.MaxOutboundConns {
+		return nil, ErrTooManyConns
+	}
+	err := network.Transport.ValidateAddr(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := network.Transport.Dial(peerAddr, time.Duration(network.Config.DialTimeout))
 	if err != nil {
 		return nil, errors.New("Failed to connect to peer")
-	} else {
-		fmt.Fprintf(conn, "PEER-REQUEST %s %s\n", network.NodeId, network.NodeAddr)
-		fmt.Fprintf(conn, "PEER-LIST\n")
-		return conn, nil
 	}
+	connInfo := network.newConnInfo(conn, peerAddr)
+	network.SetConn(conn, connInfo)
+	connInfo.SendMessage(&PeerRequest{network.NodeId, network.NodeAddr})
+	connInfo.SendMessage(network.Hello())
+	return connInfo, nil
 }
\ No newline at end of file
@@ -0,0 +1,58 @@
+package network
+
+// Read-only observer peers.
+//
+// A node started with Config.Observer follows the network without taking part in it:
+// it advertises FeatureObserver in the features of its HELLO, receives the messages of
+// its peers as any other node, but never relays gossip nor announces inventory items.
+//
+// The owner of the network marks with DenyObservers the message types that submit
+// data, like new blocks. Those messages are dropped when they are received from an
+// observer, directly or wrapped in a GOSSIP, and the observer is penalized since honest
+// observers never send them.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// capability advertised in HELLO by the observer nodes
+const FeatureObserver = "observer"
+
+var ErrObserver = errors.New("Observer nodes can't relay or submit data")
+
+// whether the current node is an observer
+func (network *Network) IsObserver() bool {
+	return network.Config.Observer
+}
+
+// whether the peer of the connection is an observer, known after the handshake
+func (connInfo *ConnInfo) IsObserver() bool {
+	hello := connInfo.GetHello()
+	return hello != nil && hello.HasFeature(FeatureObserver)
+}
+
+// drops the messages of the types @messageTypes received from observers
+func (network *Network) DenyObservers(messageTypes ...string) {
+	network.HandlersLock.Lock()
+	for _, messageType := range messageTypes {
+		network.ObserverDenied[messageType] = true
+	}
+	network.HandlersLock.Unlock()
+}
+
+func (network *Network) deniedToObservers(messageType string) bool {
+	network.HandlersLock.RLock()
+	defer network.HandlersLock.RUnlock()
+	return network.ObserverDenied[messageType]
+}
+
+// fails if the message can't be handled because its sender is an observer
+func (network *Network) checkObserver(ctx *Context, msg Message) error {
+	if !ctx.ConnInfo.IsObserver() || !network.deniedToObservers(msg.Type()) {
+		return nil
+	}
+	errorMessage := fmt.Sprintf("The message type %s was sent by an observer", msg.Type())
+	ctx.Misbehave(ScoreSpam, errorMessage)
+	return errors.New(errorMessage)
+}
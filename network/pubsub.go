@@ -0,0 +1,270 @@
+package network
+
+// Topic-based publish/subscribe.
+//
+// Each node tells its peers which topics it is subscribed to, sending the full list
+// after the handshake and whenever it changes:
+//
+//     SUBSCRIPTIONS <topic,topic,...>
+//
+// A message published on a topic is only sent to the peers subscribed to it:
+//
+//     PUBLISH <id> <origin> <topic> <ttl> <data>
+//
+// A node receiving a PUBLISH it has not seen yet delivers it to its local subscriptions
+// and relays it to its other peers subscribed to the topic, with the TTL decremented.
+// Messages are not relayed once their TTL reaches 0, and duplicates are dropped using
+// the ids of the messages already seen. Messages travel only through subscribed nodes,
+// so the subscribers of a topic must be connected to each other, directly or through
+// other subscribers.
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/impadalko/CES27Projeto/util"
+)
+
+const (
+	MaxTopics      = 100 // maximum number of topics a node is subscribed to
+	MaxTopicLength = 64
+
+	// messages waiting to be read by a subscription, newer messages are dropped when full
+	SubscriptionBuffer = 64
+)
+
+type Subscriptions struct {
+	Topics []string
+}
+
+func (msg *Subscriptions) Type() string       { return "SUBSCRIPTIONS" }
+func (msg *Subscriptions) Encode(enc Encoder) { enc.Strings(msg.Topics) }
+func (msg *Subscriptions) Decode(dec Decoder) { msg.Topics = dec.Strings() }
+
+type Publish struct {
+	Id     string // random id used to suppress duplicates
+	Origin string // nodeId of the node that published the message
+	Topic  string
+	TTL    int64 // number of hops the message may still travel
+	Data   []byte
+}
+
+func (msg *Publish) Type() string { return "PUBLISH" }
+
+func (msg *Publish) Encode(enc Encoder) {
+	enc.String(msg.Id)
+	enc.String(msg.Origin)
+	enc.String(msg.Topic)
+	enc.Int(msg.TTL)
+	enc.Bytes(msg.Data)
+}
+
+func (msg *Publish) Decode(dec Decoder) {
+	msg.Id = dec.String()
+	msg.Origin = dec.String()
+	msg.Topic = dec.String()
+	msg.TTL = dec.Int()
+	msg.Data = dec.Bytes()
+}
+
+// "-" is the empty list in the text format
+func validateTopic(topic string) error {
+	if topic == "" || topic == "-" || len(topic) > MaxTopicLength || strings.ContainsAny(topic, " ,\n") {
+		return errors.New("Invalid topic")
+	}
+	return nil
+}
+
+func ValidateSubscriptions(msg Message) error {
+	topics := msg.(*Subscriptions).Topics
+	if len(topics) > MaxTopics {
+		return errors.New("Too many topics")
+	}
+	for _, topic := range topics {
+		err := validateTopic(topic)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ValidatePublish(msg Message) error {
+	publish := msg.(*Publish)
+	if publish.Id == "" || publish.TTL <= 0 {
+		return errors.New("Invalid PUBLISH fields")
+	}
+	err := validateTopic(publish.Topic)
+	if err != nil {
+		return err
+	}
+	return validatePeerId(publish.Origin)
+}
+
+// a message received on a topic
+type Publication struct {
+	Topic  string
+	Origin string // nodeId of the node that published the message
+	Data   []byte
+}
+
+// a subscription to a topic of the current node. Messages are received from C until
+// Unsubscribe is called, which closes it
+type Subscription struct {
+	Topic   string
+	C       <-chan Publication
+	c       chan Publication
+	network *Network
+}
+
+// map: topic string => local subscriptions to the topic
+type subscriptions struct {
+	topics map[string][]*Subscription
+	lock   sync.Mutex
+}
+
+func (network *Network) Subscribe(topic string) (*Subscription, error) {
+	err := validateTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+	c := make(chan Publication, SubscriptionBuffer)
+	sub := &Subscription{topic, c, c, network}
+
+	network.Subscriptions.lock.Lock()
+	_, ok := network.Subscriptions.topics[topic]
+	if !ok && len(network.Subscriptions.topics) >= MaxTopics {
+		network.Subscriptions.lock.Unlock()
+		return nil, errors.New("Too many topics")
+	}
+	network.Subscriptions.topics[topic] = append(network.Subscriptions.topics[topic], sub)
+	network.Subscriptions.lock.Unlock()
+
+	if !ok {
+		network.SendSubscriptions()
+	}
+	return sub, nil
+}
+
+func (sub *Subscription) Unsubscribe() {
+	network := sub.network
+	network.Subscriptions.lock.Lock()
+	subs := network.Subscriptions.topics[sub.Topic]
+	found := false
+	for i, other := range subs {
+		if other == sub {
+			subs = append(subs[:i:i], subs[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		network.Subscriptions.lock.Unlock()
+		return
+	}
+	close(sub.c)
+	if len(subs) > 0 {
+		network.Subscriptions.topics[sub.Topic] = subs
+		network.Subscriptions.lock.Unlock()
+		return
+	}
+	delete(network.Subscriptions.topics, sub.Topic)
+	network.Subscriptions.lock.Unlock()
+	network.SendSubscriptions()
+}
+
+// topics the current node is subscribed to
+func (network *Network) Topics() []string {
+	network.Subscriptions.lock.Lock()
+	topics := []string{}
+	for topic := range network.Subscriptions.topics {
+		topics = append(topics, topic)
+	}
+	network.Subscriptions.lock.Unlock()
+	return topics
+}
+
+// sends the topics the current node is subscribed to to every peer
+func (network *Network) SendSubscriptions() {
+	msg := &Subscriptions{network.Topics()}
+	network.ConnsLock.RLock()
+	for _, connInfo := range network.Conns {
+		if connInfo.GetHello() != nil && connInfo.Supports(msg.Type()) && network.authorized(connInfo) {
+			connInfo.SendMessage(msg)
+		}
+	}
+	network.ConnsLock.RUnlock()
+}
+
+func HandleSubscriptions(ctx *Context, msg Message) error {
+	// the other peer sent the topics it is subscribed to
+	topics := map[string]bool{}
+	for _, topic := range msg.(*Subscriptions).Topics {
+		topics[topic] = true
+	}
+	ctx.ConnInfo.Lock.Lock()
+	ctx.ConnInfo.topics = topics
+	ctx.ConnInfo.Lock.Unlock()
+	return nil
+}
+
+// whether the peer of the connection is subscribed to @topic
+func (connInfo *ConnInfo) SubscribedTo(topic string) bool {
+	connInfo.Lock.RLock()
+	defer connInfo.Lock.RUnlock()
+	return connInfo.topics[topic]
+}
+
+// sends @data to the nodes subscribed to @topic, the current node does not receive it
+func (network *Network) Publish(topic string, data []byte) error {
+	err := validateTopic(topic)
+	if err != nil {
+		return err
+	}
+	msg := &Publish{util.RandomString(16), network.NodeId, topic, int64(network.Config.GossipTTL), data}
+	network.Seen.Add(msg.Id)
+	network.relayPublish(msg, nil)
+	return nil
+}
+
+func HandlePublish(ctx *Context, msg Message) error {
+	// the other peer sent a message published on a topic the current node is subscribed to
+	publish := msg.(*Publish)
+	network := ctx.Network
+
+	if !network.Seen.Add(publish.Id) || publish.Origin == network.NodeId {
+		// duplicate
+		return nil
+	}
+	network.deliver(Publication{publish.Topic, publish.Origin, publish.Data})
+	if publish.TTL > 1 {
+		network.relayPublish(&Publish{publish.Id, publish.Origin, publish.Topic, publish.TTL - 1, publish.Data},
+			ctx.ConnInfo)
+	}
+	return nil
+}
+
+// delivers @publication to the local subscriptions of its topic
+func (network *Network) deliver(publication Publication) {
+	network.Subscriptions.lock.Lock()
+	defer network.Subscriptions.lock.Unlock()
+	for _, sub := range network.Subscriptions.topics[publication.Topic] {
+		select {
+		case sub.c <- publication:
+		default:
+			// the subscription is not being read, the message is dropped
+		}
+	}
+}
+
+// sends @msg to the peers subscribed to its topic, other than @from
+func (network *Network) relayPublish(msg *Publish, from *ConnInfo) {
+	network.ConnsLock.RLock()
+	for _, connInfo := range network.Conns {
+		if connInfo != from && connInfo.Supports(msg.Type()) && connInfo.SubscribedTo(msg.Topic) {
+			connInfo.SendMessage(msg)
+		}
+	}
+	network.ConnsLock.RUnlock()
+}
@@ -0,0 +1,128 @@
+package network
+
+// Outbound queues.
+//
+// Messages sent to a peer are encoded and put in a bounded queue of the connection, and
+// a single writer goroutine per connection writes them in order, so messages sent from
+// different goroutines never interleave and a slow peer never blocks the sender.
+//
+// When the queue of a connection is full, the message is dropped or the peer is
+// disconnected, depending on Config.SendQueuePolicy. Writes that take longer than
+// Config.WriteTimeout close the connection.
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// policies applied when the send queue of a connection is full
+const (
+	QueueDrop       = "drop"
+	QueueDisconnect = "disconnect"
+)
+
+var (
+	ErrSendQueueFull = errors.New("Send queue is full")
+	ErrConnClosed    = errors.New("Connection is closed")
+)
+
+type outgoing struct {
+	messageType string
+	data        []byte
+	rawLength   int // length of the payload before compression, 0 if not compressed
+	flushed     chan struct{} // closed by the writer when it reaches this item, data is empty
+}
+
+// the message is encoded in the format negotiated with the peer and queued
+func (connInfo *ConnInfo) SendMessage(msg Message) error {
+	var data []byte
+	var rawLength int
+	var err error
+	if connInfo.Compresses() {
+		data, rawLength, err = EncodeCompressed(msg, connInfo.CompressionThreshold)
+		if err != nil {
+			return err
+		}
+	} else if connInfo.Version() >= BinaryFramingVersion {
+		data, err = EncodeBinary(msg)
+		if err != nil {
+			return err
+		}
+	} else {
+		data = EncodeText(msg)
+	}
+
+	select {
+	case <-connInfo.done:
+		return ErrConnClosed
+	default:
+	}
+	select {
+	case connInfo.queue <- outgoing{messageType: msg.Type(), data: data, rawLength: rawLength}:
+		return nil
+	default:
+	}
+	if connInfo.QueuePolicy == QueueDisconnect {
+		peerId, _ := connInfo.GetPeer()
+		fmt.Printf("Disconnecting %s: send queue is full\n\n", peerId)
+		connInfo.Close()
+	}
+	return ErrSendQueueFull
+}
+
+// writes the queued messages until the connection is closed
+func (connInfo *ConnInfo) writeLoop() {
+	for {
+		select {
+		case <-connInfo.done:
+			return
+		case item := <-connInfo.queue:
+			if item.flushed != nil {
+				close(item.flushed)
+				continue
+			}
+			if connInfo.WriteTimeout > 0 {
+				connInfo.Conn.SetWriteDeadline(time.Now().Add(connInfo.WriteTimeout))
+			}
+			_, err := connInfo.Conn.Write(item.data)
+			if err != nil {
+				connInfo.Close()
+				return
+			}
+			connInfo.recordOut(item.messageType, len(item.data), item.rawLength)
+		}
+	}
+}
+
+// waits until the messages queued so far are written, for at most @timeout
+func (connInfo *ConnInfo) Flush(timeout time.Duration) error {
+	flushed := make(chan struct{})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case connInfo.queue <- outgoing{flushed: flushed}:
+	case <-connInfo.done:
+		return ErrConnClosed
+	case <-timer.C:
+		return ErrSendQueueFull
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-connInfo.done:
+		return ErrConnClosed
+	case <-timer.C:
+		return errors.New("Timeout flushing send queue")
+	}
+}
+
+// closes the connection and stops its writer, the messages still queued are discarded
+func (connInfo *ConnInfo) Close() error {
+	var err error
+	connInfo.closeOnce.Do(func() {
+		close(connInfo.done)
+		err = connInfo.Conn.Close()
+	})
+	return err
+}
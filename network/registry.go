@@ -0,0 +1,77 @@
+package network
+
+// Registry of the message types understood by a network. Each type is registered with
+// a constructor, an optional validator and the handler that processes it.
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// state available to a handler while it processes a message
+type Context struct {
+	Network  *Network
+	ConnInfo *ConnInfo              // connection the message was received from
+	NewConn  net.Conn               // connection opened by the handler, it is handled after the handler returns
+	Values   map[string]interface{} // annotations added by middlewares
+
+	RequestId int64 // id of the CALL being handled, 0 when the message was not a call
+	replied   bool
+}
+
+// sends @msg back to the peer that sent the message being handled. When the message
+// was a CALL, the first reply is sent in the REPLY to the call
+func (ctx *Context) Reply(msg Message) error {
+	if ctx.RequestId != 0 && !ctx.replied {
+		ctx.replied = true
+		return ctx.ConnInfo.SendMessage(&Reply{ctx.RequestId, "", msg, nil})
+	}
+	return ctx.ConnInfo.SendMessage(msg)
+}
+
+type Handler func(ctx *Context, msg Message) error
+
+type MessageDef struct {
+	New      func() Message          // returns an empty message of the type, to be decoded
+	Validate func(msg Message) error // may be nil, called before Handle
+	Handle   Handler
+}
+
+func (def *MessageDef) Type() string {
+	return def.New().Type()
+}
+
+// returns an empty typed message for @messageType, or an UnknownMessage
+func (network *Network) NewMessage(messageType string) Message {
+	def, ok := network.GetHandler(messageType)
+	if !ok {
+		return &UnknownMessage{messageType}
+	}
+	return def.New()
+}
+
+// validators shared by the builtin messages
+
+func validatePeerId(peerId string) error {
+	if peerId == "" || strings.ContainsAny(peerId, " ,\n") {
+		return errors.New("Invalid peer id")
+	}
+	return nil
+}
+
+// the address is only checked against the transport when it is dialed
+func validatePeerAddr(peerAddr string) error {
+	if peerAddr == "" || strings.ContainsAny(peerAddr, " ,\n") {
+		return errors.New("Invalid peer address")
+	}
+	return nil
+}
+
+func validatePeer(peerId, peerAddr string) error {
+	err := validatePeerId(peerId)
+	if err != nil {
+		return err
+	}
+	return validatePeerAddr(peerAddr)
+}
@@ -0,0 +1,203 @@
+package network
+
+// Request/response calls over peer connections.
+//
+// A request is wrapped in a CALL message carrying a request id, the peer handles the
+// wrapped message with its registered handler and answers with a REPLY carrying the
+// same id:
+//
+//     CALL <requestId> <type> <fields of the message> ...
+//     REPLY <requestId> <error> <type> <fields of the message> ...
+//
+// The REPLY holds the first message sent with ctx.Reply by the handler, or only the
+// error returned by the handler. A REPLY without message ("-") is sent when the
+// handler returned without replying.
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+type Call struct {
+	RequestId int64
+	Msg       Message
+
+	newMessage func(messageType string) Message
+}
+
+func (msg *Call) Type() string { return "CALL" }
+
+func (msg *Call) Encode(enc Encoder) {
+	enc.Int(msg.RequestId)
+	enc.String(msg.Msg.Type())
+	msg.Msg.Encode(enc)
+}
+
+func (msg *Call) Decode(dec Decoder) {
+	msg.RequestId = dec.Int()
+	msg.Msg = decodeWrapped(dec, msg.newMessage)
+}
+
+func ValidateCall(msg Message) error {
+	call := msg.(*Call)
+	if call.RequestId <= 0 || call.Msg == nil {
+		return errors.New("Invalid CALL fields")
+	}
+	return nil
+}
+
+type Reply struct {
+	RequestId int64
+	Err       string  // empty when the call succeeded
+	Msg       Message // may be nil
+
+	newMessage func(messageType string) Message
+}
+
+func (msg *Reply) Type() string { return "REPLY" }
+
+func (msg *Reply) Encode(enc Encoder) {
+	enc.Int(msg.RequestId)
+	enc.Bytes([]byte(msg.Err))
+	if msg.Msg == nil {
+		enc.String("-")
+	} else {
+		enc.String(msg.Msg.Type())
+		msg.Msg.Encode(enc)
+	}
+}
+
+func (msg *Reply) Decode(dec Decoder) {
+	msg.RequestId = dec.Int()
+	msg.Err = string(dec.Bytes())
+	msg.Msg = decodeWrapped(dec, msg.newMessage)
+}
+
+// decodes a message wrapped inside another one, nil if its type is "-"
+func decodeWrapped(dec Decoder, newMessage func(messageType string) Message) Message {
+	messageType := dec.String()
+	if messageType == "" || messageType == "-" {
+		return nil
+	}
+	msg := newMessage(messageType)
+	if _, ok := msg.(*UnknownMessage); ok {
+		dec.Fail(errors.New("Unknown wrapped message type " + messageType))
+		return nil
+	}
+	msg.Decode(dec)
+	return msg
+}
+
+// a call waiting for its reply
+type pendingCall struct {
+	connInfo *ConnInfo
+	replies  chan *Reply
+}
+
+// sends @msg to the peer and waits for the message it replies with. The call fails when
+// @ctx is done, when the timeout of the network expires or when the connection is closed
+func (network *Network) Call(ctx context.Context, peerId string, msg Message) (Message, error) {
+	peer, ok := network.GetPeer(peerId)
+	if !ok {
+		return nil, errors.New("Peer not found")
+	}
+	connInfo, ok := network.GetConn(peer.Conn)
+	if !ok {
+		return nil, errors.New("Peer not found")
+	}
+	if !connInfo.Supports("CALL") || !connInfo.Supports(msg.Type()) {
+		return nil, errors.New("Peer does not support calls of " + msg.Type())
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(network.Config.CallTimeout))
+		defer cancel()
+	}
+
+	requestId := atomic.AddInt64(&network.lastRequestId, 1)
+	call := pendingCall{connInfo, make(chan *Reply, 1)}
+	network.CallsLock.Lock()
+	network.Calls[requestId] = call
+	network.CallsLock.Unlock()
+	defer network.deleteCall(requestId)
+
+	err := connInfo.SendMessage(&Call{requestId, msg, nil})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-call.replies:
+		if !ok {
+			return nil, errors.New("Connection closed")
+		}
+		if reply.Err != "" {
+			return reply.Msg, errors.New(reply.Err)
+		}
+		return reply.Msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (network *Network) deleteCall(requestId int64) {
+	network.CallsLock.Lock()
+	delete(network.Calls, requestId)
+	network.CallsLock.Unlock()
+}
+
+// fails the pending calls sent through a connection that was closed
+func (network *Network) failCalls(connInfo *ConnInfo) {
+	network.CallsLock.Lock()
+	for requestId, call := range network.Calls {
+		if call.connInfo == connInfo {
+			close(call.replies)
+			delete(network.Calls, requestId)
+		}
+	}
+	network.CallsLock.Unlock()
+}
+
+func HandleCall(ctx *Context, msg Message) error {
+	// the other peer is waiting for a reply to the wrapped message
+	call := msg.(*Call)
+
+	ctx.RequestId = call.RequestId
+	// the wrapped message goes through the middlewares like any other message
+	err := ctx.Network.chain()(ctx, call.Msg)
+	if err != nil {
+		return ctx.ConnInfo.SendMessage(&Reply{call.RequestId, err.Error(), nil, nil})
+	}
+	if !ctx.replied {
+		return ctx.ConnInfo.SendMessage(&Reply{call.RequestId, "", nil, nil})
+	}
+	return nil
+}
+
+func HandleReply(ctx *Context, msg Message) error {
+	// the other peer replied to a call of the current node
+	reply := msg.(*Reply)
+
+	network := ctx.Network
+	if reply.Msg != nil {
+		// the wrapped message is validated like any other message, the call fails if
+		// it is invalid
+		_, err := network.validate(ctx, reply.Msg)
+		if err != nil {
+			reply = &Reply{reply.RequestId, err.Error(), nil, nil}
+		}
+	}
+	network.CallsLock.Lock()
+	call, ok := network.Calls[reply.RequestId]
+	if ok && call.connInfo == ctx.ConnInfo {
+		delete(network.Calls, reply.RequestId)
+		call.replies <- reply
+	}
+	network.CallsLock.Unlock()
+
+	// replies to calls that timed out are ignored
+	return nil
+}
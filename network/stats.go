@@ -0,0 +1,184 @@
+package network
+
+// Traffic statistics of the connections.
+//
+// Every connection counts the messages and bytes it receives and sends, by message type,
+// and remembers when it was opened and when its last message was received. Compressed
+// messages are also counted apart, with the length of their payloads before compression.
+// Blocks and other items contributed by the peer are counted by the owner of the network
+// with AddBlocksContributed. Network.Stats returns a snapshot of all the connections,
+// which can be encoded as JSON for monitoring.
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+type TrafficStats struct {
+	Messages int64 `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+}
+
+func (stats *TrafficStats) add(size int) {
+	stats.Messages++
+	stats.Bytes += int64(size)
+}
+
+// messages sent compressed, see compress.go
+type CompressionStats struct {
+	Messages int64 `json:"messages"`
+	Bytes    int64 `json:"bytes"`    // bytes of the compressed frames
+	RawBytes int64 `json:"rawBytes"` // bytes of their payloads before compression
+}
+
+func (stats *CompressionStats) add(size int, rawLength int) {
+	stats.Messages++
+	stats.Bytes += int64(size)
+	stats.RawBytes += int64(rawLength)
+}
+
+// how many times the compressed messages would be larger without compression, 0 if
+// no message was compressed
+func (stats CompressionStats) Ratio() float64 {
+	if stats.Bytes == 0 {
+		return 0
+	}
+	return float64(stats.RawBytes) / float64(stats.Bytes)
+}
+
+// snapshot of the statistics of a connection
+type ConnStats struct {
+	PeerId            string                  `json:"peerId"`
+	PeerAddr          string                  `json:"peerAddr"`
+	RemoteAddr        string                  `json:"remoteAddr"`
+	Outbound          bool                    `json:"outbound"`
+	Connected         time.Time               `json:"connected"`
+	LastMessage       time.Time               `json:"lastMessage"` // zero if nothing was received
+	RTT               time.Duration           `json:"rtt"`         // nanoseconds, 0 if not measured
+	In                TrafficStats            `json:"in"`
+	Out               TrafficStats            `json:"out"`
+	InByType          map[string]TrafficStats `json:"inByType"`
+	OutByType         map[string]TrafficStats `json:"outByType"`
+	CompressedIn      CompressionStats        `json:"compressedIn"`
+	CompressedOut     CompressionStats        `json:"compressedOut"`
+	BlocksContributed int64                   `json:"blocksContributed"`
+}
+
+func (stats *ConnStats) Age() time.Duration {
+	return time.Since(stats.Connected)
+}
+
+// counters of a connection, protected by the lock of the connection
+type connStats struct {
+	connected     time.Time
+	lastMessage   time.Time
+	in            map[string]TrafficStats
+	out           map[string]TrafficStats
+	compressedIn  CompressionStats
+	compressedOut CompressionStats
+	blocks        int64
+}
+
+func newConnStats() connStats {
+	return connStats{
+		connected: time.Now(),
+		in:        map[string]TrafficStats{},
+		out:       map[string]TrafficStats{},
+	}
+}
+
+// counts the bytes read from the connection, only used by the goroutine reading it
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (reader *countingReader) Read(b []byte) (int, error) {
+	n, err := reader.reader.Read(b)
+	reader.count += int64(n)
+	return n, err
+}
+
+// bytes of the connection consumed by the messages read so far
+func (connInfo *ConnInfo) bytesRead() int64 {
+	return connInfo.counter.count - int64(connInfo.Reader.Buffered())
+}
+
+// @rawLength is the length of the payload before compression, 0 if not compressed
+func (connInfo *ConnInfo) recordIn(messageType string, size int, rawLength int) {
+	connInfo.Lock.Lock()
+	stats := connInfo.stats.in[messageType]
+	stats.add(size)
+	connInfo.stats.in[messageType] = stats
+	if rawLength > 0 {
+		connInfo.stats.compressedIn.add(size, rawLength)
+	}
+	connInfo.stats.lastMessage = time.Now()
+	connInfo.Lock.Unlock()
+}
+
+func (connInfo *ConnInfo) recordOut(messageType string, size int, rawLength int) {
+	connInfo.Lock.Lock()
+	stats := connInfo.stats.out[messageType]
+	stats.add(size)
+	connInfo.stats.out[messageType] = stats
+	if rawLength > 0 {
+		connInfo.stats.compressedOut.add(size, rawLength)
+	}
+	connInfo.Lock.Unlock()
+}
+
+// records that @count blocks received from the peer were added to the blockchain
+func (connInfo *ConnInfo) AddBlocksContributed(count int) {
+	connInfo.Lock.Lock()
+	connInfo.stats.blocks += int64(count)
+	connInfo.Lock.Unlock()
+}
+
+func (connInfo *ConnInfo) Stats() ConnStats {
+	connInfo.Lock.RLock()
+	defer connInfo.Lock.RUnlock()
+	stats := ConnStats{
+		PeerId:            connInfo.PeerId,
+		PeerAddr:          connInfo.PeerAddr,
+		RemoteAddr:        connInfo.Conn.RemoteAddr().String(),
+		Outbound:          connInfo.Outbound,
+		Connected:         connInfo.stats.connected,
+		LastMessage:       connInfo.stats.lastMessage,
+		RTT:               connInfo.RTT,
+		InByType:          map[string]TrafficStats{},
+		OutByType:         map[string]TrafficStats{},
+		CompressedIn:      connInfo.stats.compressedIn,
+		CompressedOut:     connInfo.stats.compressedOut,
+		BlocksContributed: connInfo.stats.blocks,
+	}
+	for messageType, traffic := range connInfo.stats.in {
+		stats.InByType[messageType] = traffic
+		stats.In.Messages += traffic.Messages
+		stats.In.Bytes += traffic.Bytes
+	}
+	for messageType, traffic := range connInfo.stats.out {
+		stats.OutByType[messageType] = traffic
+		stats.Out.Messages += traffic.Messages
+		stats.Out.Bytes += traffic.Bytes
+	}
+	return stats
+}
+
+// statistics of all the connections, ordered by peerId
+func (network *Network) Stats() []ConnStats {
+	network.ConnsLock.RLock()
+	stats := []ConnStats{}
+	for _, connInfo := range network.Conns {
+		stats = append(stats, connInfo.Stats())
+	}
+	network.ConnsLock.RUnlock()
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].PeerId != stats[j].PeerId {
+			return stats[i].PeerId < stats[j].PeerId
+		}
+		return stats[i].RemoteAddr < stats[j].RemoteAddr
+	})
+	return stats
+}
@@ -11,6 +11,13 @@ func (network *Network) SetConn(conn net.Conn, connInfo *ConnInfo) {
 	network.ConnsLock.Unlock()
 }
 
+func (network *Network) GetConn(conn net.Conn) (*ConnInfo, bool) {
+	network.ConnsLock.RLock()
+	connInfo, ok := network.Conns[conn]
+	network.ConnsLock.RUnlock()
+	return connInfo, ok
+}
+
 func (network *Network) DeleteConn(conn net.Conn) {
 	network.ConnsLock.Lock()
 	if _, ok := network.Conns[conn]; ok {
@@ -19,6 +26,34 @@ func (network *Network) DeleteConn(conn net.Conn) {
 	network.ConnsLock.Unlock()
 }
 
+func (connInfo *ConnInfo) GetHello() *Hello {
+	connInfo.Lock.RLock()
+	hello := connInfo.Hello
+	connInfo.Lock.RUnlock()
+	return hello
+}
+
+func (connInfo *ConnInfo) SetHello(hello *Hello) {
+	connInfo.Lock.Lock()
+	connInfo.Hello = hello
+	connInfo.Lock.Unlock()
+}
+
+// the peerId and peerAddr of the connection, empty until the peer is resolved
+func (connInfo *ConnInfo) GetPeer() (string, string) {
+	connInfo.Lock.RLock()
+	peerId, peerAddr := connInfo.PeerId, connInfo.PeerAddr
+	connInfo.Lock.RUnlock()
+	return peerId, peerAddr
+}
+
+func (connInfo *ConnInfo) SetPeer(peerId string, peerAddr string) {
+	connInfo.Lock.Lock()
+	connInfo.PeerId = peerId
+	connInfo.PeerAddr = peerAddr
+	connInfo.Lock.Unlock()
+}
+
 func (network *Network) GetPeer(peerId string) (Peer, bool) {
 	network.PeersLock.RLock()
 	peer, ok := network.Peers[peerId]
@@ -26,31 +61,72 @@ func (network *Network) GetPeer(peerId string) (Peer, bool) {
 	return peer, ok
 }
 
-func (network *Network) SetPeer(peerId string, peer Peer) {
+// the connection of the peer @peerId
+func (network *Network) GetPeerConn(peerId string) (*ConnInfo, bool) {
+	peer, ok := network.GetPeer(peerId)
+	if !ok {
+		return nil, false
+	}
+	return network.GetConn(peer.Conn)
+}
+
+// registers the peer of the connection. If the peer is already connected through another
+// connection only one of the two is kept, see keepNewConn, and the other one is closed.
+// Returns false if the new connection is the one that must be closed
+func (network *Network) AddPeer(connInfo *ConnInfo) bool {
+	peerId, peerAddr := connInfo.GetPeer()
 	network.PeersLock.Lock()
-	network.Peers[peerId] = peer
+	existing, ok := network.Peers[peerId]
+	if ok && !network.keepNewConn(connInfo, existing) {
+		network.PeersLock.Unlock()
+		return false
+	}
+	network.Peers[peerId] = Peer{peerId, peerAddr, connInfo.Conn}
 	network.PeersLock.Unlock()
+
+	if ok {
+		fmt.Printf("Replacing connection to peer: %s\n\n", peerId)
+		if existingInfo, found := network.GetConn(existing.Conn); found {
+			existingInfo.Close()
+		} else {
+			existing.Conn.Close()
+		}
+	}
+	network.AddrBook.MarkSeen(peerAddr, peerId)
 	fmt.Printf("Peer connected: %s\n\n", peerId)
+	return true
+}
+
+// when two peers dial each other at the same time, both keep the connection dialed by
+// the peer with the lower NodeId. Otherwise the connection that already exists is kept
+func (network *Network) keepNewConn(connInfo *ConnInfo, existing Peer) bool {
+	existingInfo, ok := network.GetConn(existing.Conn)
+	if !ok || existingInfo.Outbound == connInfo.Outbound {
+		return false
+	}
+	return connInfo.Outbound == (network.NodeId < existing.Id)
 }
 
-func (network *Network) DeletePeer(peerId string) {
+// removes the peer @peerId if it is connected through @conn
+func (network *Network) DeletePeer(peerId string, conn net.Conn) {
 	network.PeersLock.Lock()
-	if _, ok := network.Peers[peerId]; ok {
+	if peer, ok := network.Peers[peerId]; ok && peer.Conn == conn {
+		network.AddrBook.MarkSeen(peer.Addr, peerId)
 		delete(network.Peers, peerId)
 		fmt.Printf("Peer disconnected: %s\n\n", peerId)
 	}
 	network.PeersLock.Unlock()
 }
 
-func (network *Network) GetHandler(messageType string) (func(connInfo *ConnInfo, args []string), bool) {
+func (network *Network) GetHandler(messageType string) (*MessageDef, bool) {
 	network.HandlersLock.RLock()
-	handler, ok := network.Handlers[messageType]
+	def, ok := network.Handlers[messageType]
 	network.HandlersLock.RUnlock()
-	return handler, ok
+	return def, ok
 }
 
-func (network *Network) AddHandler(messageType string, handler func(connInfo *ConnInfo, args []string)) {
+func (network *Network) AddHandler(def MessageDef) {
 	network.HandlersLock.Lock()
-	network.Handlers[messageType] = handler
+	network.Handlers[def.Type()] = &def
 	network.HandlersLock.Unlock()
 }
\ No newline at end of file
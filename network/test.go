@@ -1,8 +1,20 @@
 package network
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/impadalko/CES27Projeto/util"
 )
 
 func TestNodeJoinNetwork() error {
@@ -34,10 +46,10 @@ func TestNodeJoinNetwork() error {
 	if err != nil {
 		return err
 	}
-	if !strings.HasPrefix(nodeAMsg, "PEER-REQUEST ") {
+	if nodeAMsg.Type() != "PEER-REQUEST" {
 		return errors.New("Expected PEER-REQUEST message")
 	}
-	
+
 	_, err = nodeA.HandleMessage(nodeAConnInfo, nodeAMsg)
 	if err != nil {
 		return err
@@ -47,7 +59,7 @@ func TestNodeJoinNetwork() error {
 	if err != nil {
 		return err
 	}
-	if !strings.HasPrefix(nodeBMsg, "PEER-ACCEPTED ") {
+	if nodeBMsg.Type() != "PEER-ACCEPTED" {
 		return errors.New("Expected PEER-ACCEPTED message")
 	}
 
@@ -56,5 +68,1366 @@ func TestNodeJoinNetwork() error {
 		return err
 	}
 
+	// both nodes exchange HELLO messages
+	nodeAMsg, err = nodeA.ReadNextMessage(nodeAConnInfo)
+	if err != nil {
+		return err
+	}
+	if nodeAMsg.Type() != "HELLO" {
+		return errors.New("Expected HELLO message")
+	}
+	_, err = nodeA.HandleMessage(nodeAConnInfo, nodeAMsg)
+	if err != nil {
+		return err
+	}
+
+	nodeBMsg, err = nodeB.ReadNextMessage(nodeBConnInfo)
+	if err != nil {
+		return err
+	}
+	if nodeBMsg.Type() != "HELLO" {
+		return errors.New("Expected HELLO message")
+	}
+	_, err = nodeB.HandleMessage(nodeBConnInfo, nodeBMsg)
+	if err != nil {
+		return err
+	}
+
+	if nodeAConnInfo.GetHello() == nil || nodeBConnInfo.GetHello() == nil {
+		return errors.New("Expected handshake to be completed")
+	}
+
+	return nil
+}
+
+func TestHelloCompatibility() error {
+	node := NewNode("A")
+	node.ChainInfo = func() (string, int64) { return "aaaa", 3 }
+
+	msg, err := ReadMessage(bufio.NewReader(bytes.NewReader(EncodeText(node.Hello()))), node.NewMessage)
+	if err != nil {
+		return err
+	}
+	hello := msg.(*Hello)
+	if hello.Version != ProtocolVersion || hello.ChainId != "aaaa" || hello.Height != 3 ||
+		!hello.HasFeature("PEER-LIST") {
+		return errors.New("HELLO mismatch")
+	}
+
+	err = node.CheckHello(&Hello{ProtocolVersion + 1, "aaaa", 5, []string{}})
+	if err != nil {
+		return err
+	}
+	err = node.CheckHello(&Hello{ProtocolVersion, NoChainId, 0, []string{}})
+	if err != nil {
+		return err
+	}
+	err = node.CheckHello(&Hello{MinProtocolVersion - 1, "aaaa", 5, []string{}})
+	if err == nil {
+		return errors.New("Expected peer with old version to be rejected")
+	}
+	err = node.CheckHello(&Hello{ProtocolVersion, "bbbb", 5, []string{}})
+	if err == nil {
+		return errors.New("Expected peer on another chain to be rejected")
+	}
+
+	// a second HELLO on the same connection is rejected
+	nodeA := NewNode("A")
+	nodeB := NewNode("B")
+	handshakes := int32(0)
+	nodeA.OnHandshake = func(connInfo *ConnInfo) { atomic.AddInt32(&handshakes, 1) }
+	err = connectNodes(nodeA, nodeB)
+	if err != nil {
+		return err
+	}
+	defer nodeA.Shutdown()
+	defer nodeB.Shutdown()
+	err = waitFor(func() bool { return atomic.LoadInt32(&handshakes) == 1 })
+	if err != nil {
+		return errors.New("Expected handshake to complete")
+	}
+	connA, _ := nodeB.GetPeerConn("A")
+	connA.SendMessage(&Hello{ProtocolVersion, NoChainId, 7, []string{}})
+	err = waitFor(func() bool {
+		connB, ok := nodeA.GetPeerConn("B")
+		if !ok {
+			return false
+		}
+		connB.Lock.RLock()
+		defer connB.Lock.RUnlock()
+		return connB.Score == ScoreSpam
+	})
+	if err != nil || atomic.LoadInt32(&handshakes) != 1 {
+		return errors.New("Expected duplicate HELLO to be rejected")
+	}
+	connB, _ := nodeA.GetPeerConn("B")
+	if connB.GetHello().Height != 0 {
+		return errors.New("Expected duplicate HELLO not to replace the first one")
+	}
+
+	return nil
+}
+
+func TestTextAndBinaryFraming() error {
+	node := NewNode("A")
+	messages := []Message{
+		&PeerRequest{"A", "127.0.0.1:1234"},
+		&Hello{ProtocolVersion, "aaaa", 42, []string{"PEER-LIST", "PEER-ADD"}},
+		&Hello{ProtocolVersion, NoChainId, 0, []string{}},
+		&PeerList{},
+	}
+
+	buffer := bytes.Buffer{}
+	for _, msg := range messages {
+		err := WriteMessage(&buffer, msg, false)
+		if err != nil {
+			return err
+		}
+		err = WriteMessage(&buffer, msg, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	// both formats can be mixed in the same stream
+	reader := bufio.NewReader(&buffer)
+	for _, msg := range messages {
+		for i := 0; i < 2; i++ {
+			read, err := ReadMessage(reader, node.NewMessage)
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(msg, read) {
+				return errors.New("Message mismatch")
+			}
+		}
+	}
+
+	// corrupted frames are detected by the checksum
+	frame, err := EncodeBinary(&PeerAdd{"B", "127.0.0.1:4321"})
+	if err != nil {
+		return err
+	}
+	frame[len(frame)-6] ^= 0xFF
+	_, err = ReadMessage(bufio.NewReader(bytes.NewReader(frame)), node.NewMessage)
+	if err == nil {
+		return errors.New("Expected checksum mismatch")
+	}
+
+	// malformed text messages do not break the stream
+	reader = bufio.NewReader(bytes.NewReader([]byte("PEER-ADD B\nPEER-LIST\n")))
+	_, err = ReadMessage(reader, node.NewMessage)
+	if _, ok := err.(*MalformedMessageError); !ok {
+		return errors.New("Expected malformed message")
+	}
+	read, err := ReadMessage(reader, node.NewMessage)
+	if err != nil {
+		return err
+	}
+	if read.Type() != "PEER-LIST" {
+		return errors.New("Expected PEER-LIST message")
+	}
+
+	return nil
+}
+
+type testMessage struct {
+	Value int64
+}
+
+func (msg *testMessage) Type() string       { return "TEST" }
+func (msg *testMessage) Encode(enc Encoder) { enc.Int(msg.Value) }
+func (msg *testMessage) Decode(dec Decoder) { msg.Value = dec.Int() }
+
+func TestMessageRegistry() error {
+	node := NewNode("A")
+	connInfo := &ConnInfo{Hello: &Hello{ProtocolVersion, NoChainId, 0, []string{"TEST"}}}
+
+	handled := int64(0)
+	node.AddHandler(MessageDef{
+		New: func() Message { return &testMessage{} },
+		Validate: func(msg Message) error {
+			if msg.(*testMessage).Value < 0 {
+				return errors.New("Negative value")
+			}
+			return nil
+		},
+		Handle: func(ctx *Context, msg Message) error {
+			if ctx.ConnInfo != connInfo {
+				return errors.New("Unexpected context")
+			}
+			handled = msg.(*testMessage).Value
+			return nil
+		},
+	})
+
+	msg, err := ReadMessage(bufio.NewReader(bytes.NewReader([]byte("TEST 7\n"))), node.NewMessage)
+	if err != nil {
+		return err
+	}
+	_, err = node.HandleMessage(connInfo, msg)
+	if err != nil {
+		return err
+	}
+	if handled != 7 {
+		return errors.New("Expected handler to receive the decoded message")
+	}
+
+	_, err = node.HandleMessage(connInfo, &testMessage{-1})
+	if err == nil || handled != 7 {
+		return errors.New("Expected invalid message to be rejected")
+	}
+
+	_, err = node.HandleMessage(connInfo, &UnknownMessage{"UNKNOWN"})
+	if err == nil {
+		return errors.New("Expected unknown message to be rejected")
+	}
+
+	return nil
+}
+
+func TestMiddlewares() error {
+	node := NewNode("A")
+	connInfo := &ConnInfo{Hello: &Hello{ProtocolVersion, NoChainId, 0, []string{"GOSSIP", "TEST"}}}
+
+	order := []string{}
+	types := []string{}
+	node.AddHandler(MessageDef{
+		New: func() Message { return &testMessage{} },
+		Handle: func(ctx *Context, msg Message) error {
+			value, _ := ctx.Get("annotation")
+			order = append(order, value.(string))
+			return nil
+		},
+	})
+	node.Use(func(next Handler) Handler {
+		return func(ctx *Context, msg Message) error {
+			order = append(order, "first")
+			types = append(types, msg.Type())
+			if test, ok := msg.(*testMessage); ok && test.Value == 0 {
+				// drop the message
+				return nil
+			}
+			return next(ctx, msg)
+		}
+	})
+	node.Use(func(next Handler) Handler {
+		return func(ctx *Context, msg Message) error {
+			order = append(order, "second")
+			ctx.Set("annotation", "handler")
+			return next(ctx, msg)
+		}
+	})
+
+	_, err := node.HandleMessage(connInfo, &testMessage{1})
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(order, []string{"first", "second", "handler"}) {
+		return errors.New("Unexpected middleware order")
+	}
+
+	order = []string{}
+	_, err = node.HandleMessage(connInfo, &testMessage{0})
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(order, []string{"first"}) {
+		return errors.New("Expected message to be dropped")
+	}
+
+	// wrapped messages also go through the middlewares
+	types = []string{}
+	_, err = node.HandleMessage(connInfo, &Gossip{"id", "B", 0, &testMessage{1}, nil})
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(types, []string{"GOSSIP", "TEST"}) {
+		return errors.New("Expected middlewares to see the wrapped message")
+	}
+
+	return nil
+}
+
+// polls @cond until it is true or a second has passed
+func waitFor(cond func() bool) error {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errors.New("Timed out waiting for condition")
+}
+
+// connects B to A and waits for the handshake to complete on both sides
+func connectNodes(nodeA, nodeB *Network) error {
+	err := nodeA.Listen()
+	if err != nil {
+		return err
+	}
+	err = nodeB.Listen()
+	if err != nil {
+		return err
+	}
+	go nodeA.Start()
+	go nodeB.Start()
+
+	conn, err := nodeB.JoinNetwork(nodeA.NodeAddr)
+	if err != nil {
+		return err
+	}
+	go nodeB.StartHandleConnection(conn)
+
+	handshaked := func(node *Network, peerId string) bool {
+		peer, ok := node.GetPeer(peerId)
+		if !ok {
+			return false
+		}
+		connInfo, ok := node.GetConn(peer.Conn)
+		return ok && connInfo.GetHello() != nil
+	}
+	return waitFor(func() bool {
+		return handshaked(nodeA, nodeB.NodeId) && handshaked(nodeB, nodeA.NodeId)
+	})
+}
+
+func TestCallAndReply() error {
+	nodeA := NewNode("A")
+	nodeB := NewNode("B")
+	for _, node := range []*Network{nodeA, nodeB} {
+		node.AddHandler(MessageDef{
+			New: func() Message { return &testMessage{} },
+			Validate: func(msg Message) error {
+				if msg.(*testMessage).Value > 1000 {
+					return errors.New("Value too large")
+				}
+				return nil
+			},
+			Handle: func(ctx *Context, msg Message) error {
+				value := msg.(*testMessage).Value
+				if value < 0 {
+					return errors.New("Negative value")
+				}
+				if value == 0 {
+					time.Sleep(200 * time.Millisecond)
+				}
+				return ctx.Reply(&testMessage{value * 2})
+			},
+		})
+	}
+	err := connectNodes(nodeA, nodeB)
+	if err != nil {
+		return err
+	}
+	defer nodeA.Close()
+	defer nodeB.Close()
+
+	reply, err := nodeB.Call(context.Background(), "A", &testMessage{21})
+	if err != nil {
+		return err
+	}
+	if reply.(*testMessage).Value != 42 {
+		return errors.New("Unexpected reply")
+	}
+
+	_, err = nodeA.Call(context.Background(), "B", &testMessage{-1})
+	if err == nil || err.Error() != "Negative value" {
+		return errors.New("Expected error of the handler to be returned")
+	}
+
+	// replies are validated like any other message
+	reply, err = nodeB.Call(context.Background(), "A", &testMessage{600})
+	if err == nil || reply != nil {
+		return errors.New("Expected invalid reply to be rejected")
+	}
+	connInfo, _ := nodeB.GetPeerConn("A")
+	connInfo.Lock.RLock()
+	score := connInfo.Score
+	connInfo.Lock.RUnlock()
+	if score != ScoreMalformed {
+		return errors.New("Expected peer sending an invalid reply to misbehave")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = nodeB.Call(ctx, "A", &testMessage{0})
+	if err != context.DeadlineExceeded {
+		return errors.New("Expected call to time out")
+	}
+
+	return nil
+}
+
+func TestGossipReachesAllNodes() error {
+	nodes := []*Network{}
+	received := make([]int64, 6)
+	for i := range received {
+		node := NewNode(string(rune('A' + i)))
+		config := DefaultConfig()
+		config.Gossip = true
+		config.TargetOutbound = 2
+		node.SetConfig(config)
+
+		count := &received[i]
+		node.AddHandler(MessageDef{
+			New: func() Message { return &testMessage{} },
+			Handle: func(ctx *Context, msg Message) error {
+				atomic.AddInt64(count, 1)
+				return nil
+			},
+		})
+		err := node.Listen()
+		if err != nil {
+			return err
+		}
+		go node.Start()
+		defer node.Close()
+		nodes = append(nodes, node)
+	}
+
+	// every node joins the network through the previous one
+	for i := 1; i < len(nodes); i++ {
+		conn, err := nodes[i].JoinNetwork(nodes[i-1].NodeAddr)
+		if err != nil {
+			return err
+		}
+		go nodes[i].StartHandleConnection(conn)
+		err = waitFor(func() bool {
+			_, ok := nodes[i-1].GetPeer(nodes[i].NodeId)
+			return ok
+		})
+		if err != nil {
+			return err
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, node := range nodes {
+		outbound, _ := node.CountConns()
+		if outbound > 2 {
+			return errors.New("Expected outbound connections to be bounded")
+		}
+	}
+
+	nodes[len(nodes)-1].Gossip(&testMessage{1})
+	err := waitFor(func() bool {
+		for i := 0; i < len(nodes)-1; i++ {
+			if atomic.LoadInt64(&received[i]) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.New("Expected gossip to reach every node")
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < len(nodes)-1; i++ {
+		if atomic.LoadInt64(&received[i]) != 1 {
+			return errors.New("Expected duplicates to be suppressed")
+		}
+	}
+
+	return nil
+}
+
+func TestAddrBookBackoff() error {
+	filename := "addrbook_test.json"
+	defer os.Remove(filename)
+
+	book, err := LoadAddrBook(filename)
+	if err != nil {
+		return err
+	}
+	book.Add("127.0.0.1:1000", "", "")
+	book.MarkSeen("127.0.0.1:2000", "B")
+	if len(book.Candidates()) != 2 {
+		return errors.New("Expected both addresses to be candidates")
+	}
+
+	book.MarkFailed("127.0.0.1:1000", time.Minute, time.Hour)
+	book.MarkFailed("127.0.0.1:1000", time.Minute, time.Hour)
+	entry := book.Entries["127.0.0.1:1000"]
+	if entry.Failures != 2 || entry.NextAttempt < util.Now()+110 {
+		return errors.New("Expected backoff to double after each failure")
+	}
+	candidates := book.Candidates()
+	if len(candidates) != 1 || candidates[0].PeerId != "B" {
+		return errors.New("Expected failed address to be skipped")
+	}
+
+	err = book.Save()
+	if err != nil {
+		return err
+	}
+	loaded, err := LoadAddrBook(filename)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(loaded.Entries, book.Entries) {
+		return errors.New("Address book mismatch")
+	}
+
+	return nil
+}
+
+func TestHeartbeats() error {
+	nodeA := NewNode("A")
+	nodeB := NewNode("B")
+	err := connectNodes(nodeA, nodeB)
+	if err != nil {
+		return err
+	}
+
+	connInfo := func(node *Network, peerId string) *ConnInfo {
+		peer, _ := node.GetPeer(peerId)
+		connInfo, _ := node.GetConn(peer.Conn)
+		return connInfo
+	}
+	nodeA.SendPings()
+	err = waitFor(func() bool { return connInfo(nodeA, "B").GetRTT() > 0 })
+	if err != nil {
+		return errors.New("Expected latency to be measured")
+	}
+
+	// node B stops answering, so node A evicts it after MaxMissedPings
+	nodeB.AddHandler(MessageDef{func() Message { return &Ping{} }, nil,
+		func(ctx *Context, msg Message) error { return nil }})
+	for i := 0; i <= nodeA.Config.MaxMissedPings; i++ {
+		nodeA.SendPings()
+	}
+	err = waitFor(func() bool {
+		_, ok := nodeA.GetPeer("B")
+		return !ok
+	})
+	if err != nil {
+		return errors.New("Expected peer with missed heartbeats to be evicted")
+	}
+
+	return nil
+}
+
+func TestLeave() error {
+	nodeA := NewNode("A")
+	nodeB := NewNode("B")
+	err := connectNodes(nodeA, nodeB)
+	if err != nil {
+		return err
+	}
+
+	err = nodeA.Shutdown()
+	if err != nil {
+		return err
+	}
+	if nodeA.CountPeers() != 0 {
+		return errors.New("Expected all connections to be closed")
+	}
+	err = waitFor(func() bool { return nodeB.CountPeers() == 0 })
+	if err != nil {
+		return errors.New("Expected peer to leave")
+	}
+	_, err = nodeA.Dial(nodeB.NodeAddr)
+	if err != ErrClosing {
+		return errors.New("Expected node to stop dialing")
+	}
+
+	return nodeA.Shutdown()
+}
+
+func TestSendQueue() error {
+	node := NewNode("A")
+	node.Config.SendQueueSize = 2
+	node.Config.SendQueuePolicy = QueueDrop
+
+	// the peer never reads, so the writer blocks on the first message
+	conn, peerConn := net.Pipe()
+	defer peerConn.Close()
+	connInfo := node.newConnInfo(conn, "")
+	defer connInfo.Close()
+	for i := 0; i < 3; i++ {
+		err := connInfo.SendMessage(&testMessage{int64(i)})
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			err = waitFor(func() bool { return len(connInfo.queue) == 0 })
+			if err != nil {
+				return errors.New("Expected writer to take the first message")
+			}
+		}
+	}
+	if connInfo.SendMessage(&testMessage{3}) != ErrSendQueueFull {
+		return errors.New("Expected message to be dropped")
+	}
+
+	// the queued messages are written in order once the peer reads
+	reader := bufio.NewReader(peerConn)
+	for i := 0; i < 3; i++ {
+		msg, err := ReadMessage(reader, func(string) Message { return &testMessage{} })
+		if err != nil {
+			return err
+		}
+		if msg.(*testMessage).Value != int64(i) {
+			return errors.New("Expected messages in order")
+		}
+	}
+
+	// with the disconnect policy a full queue closes the connection
+	node.Config.SendQueuePolicy = QueueDisconnect
+	conn, peerConn = net.Pipe()
+	defer peerConn.Close()
+	connInfo = node.newConnInfo(conn, "")
+	for i := 0; i < 4; i++ {
+		connInfo.SendMessage(&testMessage{int64(i)})
+	}
+	if connInfo.SendMessage(&testMessage{4}) != ErrConnClosed {
+		return errors.New("Expected slow peer to be disconnected")
+	}
+
+	return nil
+}
+
+func TestMisbehaviourBan() error {
+	filename := "banlist_test.json"
+	defer os.Remove(filename)
+
+	nodeA := NewNode("A")
+	nodeB := NewNode("B")
+	var err error
+	nodeA.BanList, err = LoadBanList(filename)
+	if err != nil {
+		return err
+	}
+	err = connectNodes(nodeA, nodeB)
+	if err != nil {
+		return err
+	}
+
+	// node B sends messages that node A does not know until it is banned
+	peer, _ := nodeB.GetPeer("A")
+	connInfo, _ := nodeB.GetConn(peer.Conn)
+	ip, _, _ := net.SplitHostPort(connInfo.Conn.LocalAddr().String())
+	for i := 0; i < nodeA.Config.BanThreshold/ScoreUnknownType; i++ {
+		connInfo.SendMessage(&testMessage{int64(i)})
+	}
+	err = waitFor(func() bool { return nodeA.CountPeers() == 0 && nodeB.CountPeers() == 0 })
+	if err != nil {
+		return errors.New("Expected misbehaving peer to be disconnected")
+	}
+	if !nodeA.BanList.IsBanned("B") || !nodeA.BanList.IsBanned(ip) {
+		return errors.New("Expected misbehaving peer to be banned")
+	}
+
+	// the ban is persisted, and a banned peer can't join again
+	loaded, err := LoadBanList(filename)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(loaded.List(), nodeA.BanList.List()) {
+		return errors.New("Ban list mismatch")
+	}
+	conn, err := nodeB.JoinNetwork(nodeA.NodeAddr)
+	if err != nil {
+		return err
+	}
+	go nodeB.StartHandleConnection(conn)
+	time.Sleep(100 * time.Millisecond)
+	if nodeA.CountPeers() != 0 {
+		return errors.New("Expected banned peer to be rejected")
+	}
+
+	err = nodeA.BanList.Unban(ip)
+	if err != nil {
+		return err
+	}
+	if nodeA.BanList.IsBanned(ip) || !nodeA.BanList.IsBanned("B") {
+		return errors.New("Expected only the IP to be unbanned")
+	}
+
+	return nil
+}
+
+func TestResourceLimits() error {
+	newMessage := func(string) Message { return &testMessage{} }
+	line := append(bytes.Repeat([]byte("A"), 100), '\n')
+	_, err := ReadMessageLimit(bufio.NewReaderSize(bytes.NewReader(line), 16), 64, newMessage)
+	if err != ErrMessageTooLarge {
+		return errors.New("Expected long text line to be rejected")
+	}
+	frame, err := EncodeBinary(&Hello{ProtocolVersion, NoChainId, 0, []string{string(line)}})
+	if err != nil {
+		return err
+	}
+	_, err = ReadMessageLimit(bufio.NewReader(bytes.NewReader(frame)), 64, newMessage)
+	if err != ErrMessageTooLarge {
+		return errors.New("Expected large binary frame to be rejected")
+	}
+
+	connInfo := ConnInfo{}
+	limit := RateLimit{Rate: 0, Burst: 3}
+	for i := 0; i < limit.Burst; i++ {
+		if !connInfo.allow("TEST", limit) {
+			return errors.New("Expected burst to be allowed")
+		}
+	}
+	if connInfo.allow("TEST", limit) || !connInfo.allow("OTHER", limit) {
+		return errors.New("Expected rate limit per message type")
+	}
+
+	// a second connection from the same IP is closed right away
+	node := NewNode("A")
+	node.Config.MaxConnsPerIP = 1
+	err = node.Listen()
+	if err != nil {
+		return err
+	}
+	go node.Start()
+	defer node.Shutdown()
+	first, err := net.Dial("tcp", node.NodeAddr)
+	if err != nil {
+		return err
+	}
+	defer first.Close()
+	ip, _, _ := net.SplitHostPort(first.LocalAddr().String())
+	err = waitFor(func() bool { return node.CountConnsFrom(ip) == 1 })
+	if err != nil {
+		return err
+	}
+	second, err := net.Dial("tcp", node.NodeAddr)
+	if err != nil {
+		return err
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		return errors.New("Expected connection over the per-IP limit to be closed")
+	}
+
+	return nil
+}
+
+// dials node A from node B and node B from node A at the same time
+func dialEachOther(nodeA, nodeB *Network) error {
+	errs := make(chan error, 2)
+	dial := func(from, to *Network) {
+		conn, err := from.Dial(to.NodeAddr)
+		if err == nil {
+			go from.StartHandleConnection(conn)
+		}
+		errs <- err
+	}
+	go dial(nodeA, nodeB)
+	go dial(nodeB, nodeA)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checks that nodes A and B are peers through a single connection, dialed by node A
+func singleConnection(nodeA, nodeB *Network) bool {
+	peerA, okA := nodeA.GetPeer(nodeB.NodeId)
+	peerB, okB := nodeB.GetPeer(nodeA.NodeId)
+	outboundA, inboundA := nodeA.CountConns()
+	outboundB, inboundB := nodeB.CountConns()
+	return okA && okB && outboundA == 1 && inboundA == 0 && outboundB == 0 && inboundB == 1 &&
+		peerA.Conn.LocalAddr().String() == peerB.Conn.RemoteAddr().String()
+}
+
+func TestSimultaneousDial() error {
+	for round := 0; round < 10; round++ {
+		nodeA := NewNode("A")
+		nodeB := NewNode("B")
+		err := nodeA.Listen()
+		if err != nil {
+			return err
+		}
+		err = nodeB.Listen()
+		if err != nil {
+			return err
+		}
+		go nodeA.Start()
+		go nodeB.Start()
+
+		if round%2 == 0 {
+			// force the worst order: both nodes accept the PEER-REQUEST of the other
+			// before any of them receives a PEER-ACCEPTED
+			requests := int32(0)
+			accepted := make(chan struct{})
+			barrier := func(next Handler) Handler {
+				return func(ctx *Context, msg Message) error {
+					if msg.Type() == "PEER-ACCEPTED" {
+						<-accepted
+					}
+					err := next(ctx, msg)
+					if msg.Type() == "PEER-REQUEST" && atomic.AddInt32(&requests, 1) == 2 {
+						close(accepted)
+					}
+					return err
+				}
+			}
+			nodeA.Use(barrier)
+			nodeB.Use(barrier)
+		}
+
+		err = dialEachOther(nodeA, nodeB)
+		if err != nil {
+			return err
+		}
+		err = waitFor(func() bool { return singleConnection(nodeA, nodeB) })
+		if err != nil {
+			return errors.New("Expected exactly one connection dialed by the lower NodeId")
+		}
+		// the connection stays alone after the duplicate is closed
+		time.Sleep(50 * time.Millisecond)
+		if !singleConnection(nodeA, nodeB) {
+			return errors.New("Expected exactly one connection dialed by the lower NodeId")
+		}
+
+		nodeA.Shutdown()
+		nodeB.Shutdown()
+	}
+	return nil
+}
+
+func TestTransports() error {
+	for _, transport := range []Transport{TCPTransport{}, UnixTransport{}, NewMemoryTransport()} {
+		nodeA := NewNode("A")
+		nodeB := NewNode("B")
+		nodeA.Transport = transport
+		nodeB.Transport = transport
+		err := connectNodes(nodeA, nodeB)
+		if err != nil {
+			return err
+		}
+		if transport.ValidateAddr(nodeA.NodeAddr) != nil {
+			return errors.New("Expected address of the transport")
+		}
+		_, err = nodeB.Call(context.Background(), "A", &PeerList{})
+		if err != nil {
+			return err
+		}
+
+		nodeA.Shutdown()
+		nodeB.Shutdown()
+		_, err = transport.Dial(nodeA.NodeAddr, time.Second)
+		if err == nil {
+			return errors.New("Expected closed listener to refuse connections")
+		}
+	}
+
+	// dialing a listener that never accepts the connection times out
+	transport := NewMemoryTransport()
+	listener, err := transport.Listen(AnyAddr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	_, err = transport.Dial(listener.Addr().String(), 50*time.Millisecond)
+	if err == nil {
+		return errors.New("Expected dial to time out")
+	}
+	return nil
+}
+
+func TestAddrGossip() error {
+	book, _ := LoadAddrBook("")
+	now := util.Now()
+	if !book.Merge(AddrInfo{"B", "127.0.0.1:1000", now - 60}, 3600, "A") {
+		return errors.New("Expected fresh address to be merged")
+	}
+	if book.Merge(AddrInfo{"B", "127.0.0.1:1000", now - 120}, 3600, "A") ||
+		book.Merge(AddrInfo{"C", "127.0.0.1:2000", now - 7200}, 3600, "A") ||
+		book.Merge(AddrInfo{"D", "127.0.0.1:3000", now + 2*MaxAddrClockSkew}, 3600, "A") {
+		return errors.New("Expected stale addresses to be ignored")
+	}
+
+	// a single peer can only add MaxAddrsPerSource addresses
+	for i := 1; i <= 2*MaxAddrsPerSource; i++ {
+		book.Merge(AddrInfo{"E", fmt.Sprintf("10.0.0.1:%d", i), now - 600}, 3600, "E")
+	}
+	if len(book.Entries) != 1+MaxAddrsPerSource {
+		return errors.New("Expected addresses added by a single peer to be limited")
+	}
+
+	// a full address book evicts the oldest address learned from other peers for fresher
+	// ones, and never evicts seeds nor the addresses of peers it connected to
+	book.AddSeed("127.0.0.1:7000")
+	book.MarkSeen("127.0.0.1:8000", "I")
+	book.Entries["127.0.0.1:8000"].LastSeen = now - 3000
+	for i := 1; len(book.Entries) < MaxAddrBookSize; i++ {
+		source := fmt.Sprintf("S%d", i%4)
+		book.Merge(AddrInfo{"S", fmt.Sprintf("10.0.0.2:%d", i), now - 600}, 3600, source)
+	}
+	if book.Merge(AddrInfo{"F", "127.0.0.1:4000", now - 900}, 3600, "F") {
+		return errors.New("Expected address older than a full address book to be ignored")
+	}
+	if !book.Merge(AddrInfo{"G", "127.0.0.1:5000", now - 30}, 3600, "G") ||
+		len(book.Entries) != MaxAddrBookSize {
+		return errors.New("Expected oldest address to be evicted")
+	}
+	book.Add("127.0.0.1:6000", "H", "H")
+	if _, ok := book.Entries["127.0.0.1:6000"]; !ok || len(book.Entries) != MaxAddrBookSize {
+		return errors.New("Expected address book size to be capped")
+	}
+	for _, addr := range []string{"127.0.0.1:1000", "127.0.0.1:7000", "127.0.0.1:8000"} {
+		if _, ok := book.Entries[addr]; !ok {
+			return errors.New("Expected fresh addresses, seeds and connected peers to be kept")
+		}
+	}
+
+	// node C connects to node A after node B, without requesting a PEER-LIST, and node B
+	// learns its address from the ADDR gossip of node A
+	nodeA := NewNode("A")
+	nodeB := NewNode("B")
+	nodeC := NewNode("C")
+	err := connectNodes(nodeA, nodeB)
+	if err != nil {
+		return err
+	}
+	defer nodeA.Shutdown()
+	defer nodeB.Shutdown()
+	err = nodeC.Listen()
+	if err != nil {
+		return err
+	}
+	go nodeC.Start()
+	defer nodeC.Shutdown()
+	conn, err := nodeC.Dial(nodeA.NodeAddr)
+	if err != nil {
+		return err
+	}
+	go nodeC.StartHandleConnection(conn)
+	err = waitFor(func() bool {
+		nodeA.SendAddrs()
+		nodeB.AddrBook.Lock.RLock()
+		defer nodeB.AddrBook.Lock.RUnlock()
+		entry, ok := nodeB.AddrBook.Entries[nodeC.NodeAddr]
+		return ok && entry.PeerId == "C"
+	})
+	if err != nil {
+		return errors.New("Expected address of a later peer to be gossiped")
+	}
+
+	return nil
+}
+
+func TestConnStats() error {
+	nodeA := NewNode("A")
+	nodeB := NewNode("B")
+	err := connectNodes(nodeA, nodeB)
+	if err != nil {
+		return err
+	}
+	defer nodeA.Shutdown()
+	defer nodeB.Shutdown()
+
+	nodeA.SendPings()
+	connA, _ := nodeA.GetPeerConn("B")
+	connB, _ := nodeB.GetPeerConn("A")
+	err = waitFor(func() bool { return connA.GetRTT() > 0 })
+	if err != nil {
+		return errors.New("Expected latency to be measured")
+	}
+	connA.AddBlocksContributed(2)
+
+	// messages sent are counted once written, possibly after the reply was received
+	var statsA, statsB ConnStats
+	err = waitFor(func() bool {
+		statsA, statsB = connA.Stats(), connB.Stats()
+		return statsA.OutByType["PING"].Messages == 1 && statsB.InByType["PING"].Messages == 1 &&
+			statsB.OutByType["PONG"].Messages == 1 && statsA.InByType["PONG"].Messages == 1
+	})
+	if err != nil {
+		return errors.New("Expected messages to be counted by type")
+	}
+	if statsA.OutByType["PING"].Bytes != statsB.InByType["PING"].Bytes || statsA.OutByType["PING"].Bytes == 0 {
+		return errors.New("Expected bytes of a message to match on both sides")
+	}
+	if statsA.In.Messages < statsA.InByType["PONG"].Messages || statsA.LastMessage.IsZero() ||
+		statsA.RTT == 0 || statsA.BlocksContributed != 2 || statsB.Outbound == statsA.Outbound {
+		return errors.New("Connection stats mismatch")
+	}
+	stats := nodeA.Stats()
+	if len(stats) != 1 || stats[0].PeerId != "B" {
+		return errors.New("Expected stats of every connection")
+	}
+
+	return nil
+}
+
+func TestPubSub() error {
+	// nodes A and C are only connected through node B
+	nodeA := NewNode("A")
+	nodeB := NewNode("B")
+	nodeC := NewNode("C")
+	err := connectNodes(nodeB, nodeA)
+	if err != nil {
+		return err
+	}
+	defer nodeA.Shutdown()
+	defer nodeB.Shutdown()
+	err = nodeC.Listen()
+	if err != nil {
+		return err
+	}
+	go nodeC.Start()
+	defer nodeC.Shutdown()
+	conn, err := nodeC.Dial(nodeB.NodeAddr)
+	if err != nil {
+		return err
+	}
+	go nodeC.StartHandleConnection(conn)
+
+	subB, err := nodeB.Subscribe("news")
+	if err != nil {
+		return err
+	}
+	subC, err := nodeC.Subscribe("news")
+	if err != nil {
+		return err
+	}
+	err = waitFor(func() bool {
+		connA, okA := nodeA.GetPeerConn("B")
+		connB, okB := nodeB.GetPeerConn("C")
+		return okA && okB && connA.SubscribedTo("news") && connB.SubscribedTo("news")
+	})
+	if err != nil {
+		return errors.New("Expected subscriptions to reach the peers")
+	}
+
+	receive := func(sub *Subscription) (Publication, error) {
+		select {
+		case publication := <-sub.C:
+			return publication, nil
+		case <-time.After(time.Second):
+			return Publication{}, errors.New("Expected message on subscribed topic")
+		}
+	}
+	err = nodeA.Publish("news", []byte("hello"))
+	if err != nil {
+		return err
+	}
+	for _, sub := range []*Subscription{subB, subC} {
+		publication, err := receive(sub)
+		if err != nil {
+			return err
+		}
+		if publication.Origin != "A" || string(publication.Data) != "hello" {
+			return errors.New("Publication mismatch")
+		}
+	}
+
+	// node B does not relay messages whose TTL ends with it, nor duplicates
+	connA, _ := nodeA.GetPeerConn("B")
+	msg := &Publish{"id", "A", "news", 1, []byte("once")}
+	connA.SendMessage(msg)
+	connA.SendMessage(msg)
+	_, err = receive(subB)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-subB.C:
+		return errors.New("Expected duplicate to be dropped")
+	case <-subC.C:
+		return errors.New("Expected message to expire")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// node A is not subscribed, so messages on the topic are not sent to it
+	subB.Unsubscribe()
+	err = nodeC.Publish("news", []byte("hello"))
+	if err != nil {
+		return err
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := <-subB.C; ok {
+		return errors.New("Expected subscription to be closed")
+	}
+	if nodeA.Stats()[0].InByType["PUBLISH"].Messages != 0 {
+		return errors.New("Expected messages to be sent only to subscribed peers")
+	}
+
+	return nil
+}
+
+func TestCompression() error {
+	hashes := []string{}
+	for i := 0; i < 100; i++ {
+		hashes = append(hashes, strings.Repeat("ab", 32))
+	}
+	msg := &Inv{"block", hashes}
+	frame, rawLength, err := EncodeCompressed(msg, 1024)
+	if err != nil {
+		return err
+	}
+	if frame[0] != CompressedFrameMagic || rawLength == 0 || len(frame) >= rawLength {
+		return errors.New("Expected large payload to be compressed")
+	}
+	read, err := ReadMessage(bufio.NewReader(bytes.NewReader(frame)), func(string) Message { return &Inv{} })
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(read, msg) {
+		return errors.New("Decompressed message mismatch")
+	}
+	small, _, err := EncodeCompressed(&Inv{"block", hashes[:1]}, 1024)
+	if err != nil {
+		return err
+	}
+	if small[0] != FrameMagic {
+		return errors.New("Expected small payload not to be compressed")
+	}
+
+	// a frame that decompresses to another length than announced is rejected
+	offset := 2 + len(msg.Type()) + 4
+	binary.BigEndian.PutUint32(frame[offset:], uint32(rawLength-1))
+	_, err = ReadMessage(bufio.NewReader(bytes.NewReader(frame)), func(string) Message { return &Inv{} })
+	if _, ok := err.(*MalformedMessageError); !ok {
+		return errors.New("Expected payload length mismatch to be rejected")
+	}
+
+	// compression is only used when both peers advertise it
+	nodeA := NewNode("A")
+	nodeB := NewNode("B")
+	nodeC := NewNode("C")
+	nodeC.Config.CompressionThreshold = 0
+	err = connectNodes(nodeA, nodeB)
+	if err != nil {
+		return err
+	}
+	defer nodeA.Shutdown()
+	defer nodeB.Shutdown()
+	err = nodeC.Listen()
+	if err != nil {
+		return err
+	}
+	go nodeC.Start()
+	defer nodeC.Shutdown()
+	conn, err := nodeC.Dial(nodeA.NodeAddr)
+	if err != nil {
+		return err
+	}
+	go nodeC.StartHandleConnection(conn)
+	err = waitFor(func() bool {
+		connInfo, ok := nodeA.GetPeerConn("C")
+		return ok && connInfo.GetHello() != nil
+	})
+	if err != nil {
+		return err
+	}
+	connB, _ := nodeA.GetPeerConn("B")
+	connC, _ := nodeA.GetPeerConn("C")
+	if !connB.Compresses() || connC.Compresses() {
+		return errors.New("Expected compression to be negotiated")
+	}
+
+	publish := &Publish{"id", "A", "test", 1, bytes.Repeat([]byte("a"), 4096)}
+	connB.SendMessage(publish)
+	err = waitFor(func() bool {
+		connInfo, _ := nodeB.GetPeerConn("A")
+		return connInfo.Stats().CompressedIn.Messages == 1 && connB.Stats().CompressedOut.Messages == 1
+	})
+	if err != nil {
+		return errors.New("Expected compressed message to be received")
+	}
+	sent := connB.Stats().CompressedOut
+	connInfo, _ := nodeB.GetPeerConn("A")
+	received := connInfo.Stats().CompressedIn
+	if sent != received || sent.Ratio() <= 1 {
+		return errors.New("Expected compression ratio on both sides")
+	}
+
+	return nil
+}
+
+func TestObserver() error {
+	// counts the TEST messages handled by a node and remembers the last value
+	handler := func(node *Network, count *int64, last *int64) {
+		node.AddHandler(MessageDef{
+			New: func() Message { return &testMessage{} },
+			Handle: func(ctx *Context, msg Message) error {
+				atomic.AddInt64(count, 1)
+				atomic.StoreInt64(last, msg.(*testMessage).Value)
+				return nil
+			},
+		})
+	}
+	nodeA := NewNode("A")
+	nodeB := NewNode("B")
+	nodeC := NewNode("C")
+	nodeB.Config.Observer = true
+	countA, lastA := int64(0), int64(0)
+	countB, lastB := int64(0), int64(0)
+	countC, lastC := int64(0), int64(0)
+	handler(nodeA, &countA, &lastA)
+	handler(nodeB, &countB, &lastB)
+	handler(nodeC, &countC, &lastC)
+	nodeA.DenyObservers("TEST")
+	nodeC.DenyObservers("TEST")
+
+	// node B observes node A, and node C joins node B
+	err := connectNodes(nodeA, nodeB)
+	if err != nil {
+		return err
+	}
+	defer nodeA.Shutdown()
+	defer nodeB.Shutdown()
+	err = nodeC.Listen()
+	if err != nil {
+		return err
+	}
+	go nodeC.Start()
+	defer nodeC.Shutdown()
+	conn, err := nodeC.Dial(nodeB.NodeAddr)
+	if err != nil {
+		return err
+	}
+	go nodeC.StartHandleConnection(conn)
+	err = waitFor(func() bool {
+		connInfo, ok := nodeC.GetPeerConn("B")
+		return ok && connInfo.GetHello() != nil
+	})
+	if err != nil {
+		return err
+	}
+
+	connB, _ := nodeA.GetPeerConn("B")
+	connA, _ := nodeB.GetPeerConn("A")
+	if !connB.IsObserver() || connA.IsObserver() || !nodeB.IsObserver() {
+		return errors.New("Expected observer role to be negotiated")
+	}
+
+	// the observer receives messages of every type
+	connB.SendMessage(&testMessage{1})
+	err = waitFor(func() bool { return atomic.LoadInt64(&lastB) == 1 })
+	if err != nil {
+		return errors.New("Expected observer to receive message")
+	}
+
+	// messages denied to observers are dropped, whether sent directly or gossiped
+	connA.SendMessage(&testMessage{2})
+	nodeB.Gossip(&testMessage{3})
+	err = waitFor(func() bool {
+		connB.Lock.RLock()
+		defer connB.Lock.RUnlock()
+		return connB.Score >= 2*ScoreSpam
+	})
+	if err != nil {
+		return errors.New("Expected observer to be penalized")
+	}
+	if atomic.LoadInt64(&countA) != 0 {
+		return errors.New("Expected message from observer to be dropped")
+	}
+
+	// the observer does not relay gossip nor announce inventory
+	nodeA.Gossip(&testMessage{4})
+	err = waitFor(func() bool { return atomic.LoadInt64(&lastB) == 4 })
+	if err != nil {
+		return errors.New("Expected observer to receive gossip")
+	}
+	nodeB.Announce("block", "hash")
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt64(&countC) != 0 || connA.Stats().OutByType["INV"].Messages != 0 {
+		return errors.New("Expected observer not to relay")
+	}
+
+	return nil
+}
+
+func TestInventory() error {
+	// node A is connected to nodes B and C, which both have the item "h1"
+	nodeA := NewNode("A")
+	nodeB := NewNode("B")
+	nodeC := NewNode("C")
+	received := int64(0)
+	for _, node := range []*Network{nodeA, nodeB, nodeC} {
+		has := node != nodeA
+		node.AddHandler(MessageDef{
+			New: func() Message { return &testMessage{} },
+			Handle: func(ctx *Context, msg Message) error {
+				atomic.AddInt64(&received, 1)
+				return nil
+			},
+		})
+		node.AddInventory(Inventory{
+			Kind: "item",
+			Has: func(hash string) bool {
+				return hash == "h1" && (has || atomic.LoadInt64(&received) > 0)
+			},
+			Get: func(hash string) (Message, bool) {
+				return &testMessage{7}, has && hash == "h1"
+			},
+		})
+	}
+	err := connectNodes(nodeA, nodeB)
+	if err != nil {
+		return err
+	}
+	defer nodeA.Shutdown()
+	defer nodeB.Shutdown()
+	err = nodeC.Listen()
+	if err != nil {
+		return err
+	}
+	go nodeC.Start()
+	defer nodeC.Shutdown()
+	conn, err := nodeC.Dial(nodeA.NodeAddr)
+	if err != nil {
+		return err
+	}
+	go nodeC.StartHandleConnection(conn)
+	err = waitFor(func() bool {
+		connInfo, ok := nodeA.GetPeerConn("C")
+		return ok && connInfo.GetHello() != nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// an item announced by two peers is fetched only once
+	nodeB.Announce("item", "h1")
+	nodeC.Announce("item", "h1")
+	connB, _ := nodeA.GetPeerConn("B")
+	connC, _ := nodeA.GetPeerConn("C")
+	err = waitFor(func() bool {
+		return connB.Stats().InByType["INV"].Messages == 1 && connC.Stats().InByType["INV"].Messages == 1 &&
+			atomic.LoadInt64(&received) == 1
+	})
+	if err != nil {
+		return errors.New("Expected announced item to be fetched")
+	}
+	time.Sleep(100 * time.Millisecond)
+	getData := connB.Stats().OutByType["GETDATA"].Messages + connC.Stats().OutByType["GETDATA"].Messages
+	if getData != 1 || atomic.LoadInt64(&received) != 1 {
+		return errors.New("Expected item announced by two peers to be fetched once")
+	}
+
+	// the item is not announced again to the peers that know it
+	nodeA.Announce("item", "h1")
+	nodeB.Announce("item", "h1")
+	time.Sleep(100 * time.Millisecond)
+	if connB.Stats().OutByType["INV"].Messages != 0 || connC.Stats().OutByType["INV"].Messages != 0 ||
+		connB.Stats().InByType["INV"].Messages != 1 {
+		return errors.New("Expected item not to be announced to peers that know it")
+	}
+
+	// the remembered requests are capped, the items over the cap are still requested
+	hashes := []string{}
+	for i := 0; i <= MaxRequestedItems; i++ {
+		hashes = append(hashes, fmt.Sprintf("flood%d", i))
+	}
+	missing := nodeA.Inventories.request("item", hashes, time.Minute)
+	nodeA.Inventories.lock.RLock()
+	requested := len(nodeA.Inventories.requested)
+	nodeA.Inventories.lock.RUnlock()
+	if len(missing) != len(hashes) || requested != MaxRequestedItems {
+		return errors.New("Expected remembered requests to be capped")
+	}
 	return nil
-}
\ No newline at end of file
+}
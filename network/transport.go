@@ -0,0 +1,209 @@
+package network
+
+// Transports carry the connections between peers. The transport of a network is chosen
+// with Config.Transport, all the nodes of a network must use the same transport.
+//
+//     tcp     addresses are host:port, ":0" listens on a random port
+//     unix    addresses are paths of Unix domain sockets, ":0" picks a temporary path
+//     memory  addresses are names in the current process, ":0" picks a free name. The
+//             connections are made with net.Pipe, so many nodes can run in a single
+//             process without using real ports
+//
+// Addresses are sent to other peers in text, so they must not contain spaces or commas.
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+	ValidateAddr(addr string) error // checks that @addr is an address of the transport
+}
+
+// map: name string => transport, selected by Config.Transport
+var Transports = map[string]Transport{
+	"tcp":    TCPTransport{},
+	"unix":   UnixTransport{},
+	"memory": Memory,
+}
+
+// the address used to listen on a random port, or its equivalent in each transport
+const AnyAddr = ":0"
+
+// TCP
+
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (TCPTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func (TCPTransport) ValidateAddr(addr string) error {
+	_, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.New("Invalid TCP address")
+	}
+	return nil
+}
+
+// Unix domain sockets
+
+type UnixTransport struct{}
+
+func (UnixTransport) Listen(addr string) (net.Listener, error) {
+	if addr == AnyAddr {
+		// reserve a unique name, the socket is created in its place
+		file, err := ioutil.TempFile("", "ces27-*.sock")
+		if err != nil {
+			return nil, err
+		}
+		addr = file.Name()
+		file.Close()
+		os.Remove(addr)
+	}
+	return net.Listen("unix", addr)
+}
+
+func (UnixTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", addr, timeout)
+}
+
+func (UnixTransport) ValidateAddr(addr string) error {
+	if !filepath.IsAbs(addr) {
+		return errors.New("Invalid Unix socket address")
+	}
+	return nil
+}
+
+// in-memory
+
+// a set of in-memory listeners, nodes can only connect to nodes of the same set
+type MemoryTransport struct {
+	listeners map[string]*memoryListener
+	lastId    int
+	lock      sync.Mutex
+}
+
+// the in-memory transport selected by Config.Transport
+var Memory = NewMemoryTransport()
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{listeners: map[string]*memoryListener{}}
+}
+
+const memoryPrefix = "mem-"
+
+func (transport *MemoryTransport) newAddr() memoryAddr {
+	transport.lastId++
+	return memoryAddr(fmt.Sprintf("%s%d", memoryPrefix, transport.lastId))
+}
+
+func (transport *MemoryTransport) Listen(addr string) (net.Listener, error) {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	if addr == AnyAddr {
+		addr = string(transport.newAddr())
+	}
+	if _, ok := transport.listeners[addr]; ok {
+		return nil, errors.New("Address already in use")
+	}
+	listener := &memoryListener{
+		transport: transport,
+		addr:      memoryAddr(addr),
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	transport.listeners[addr] = listener
+	return listener, nil
+}
+
+func (transport *MemoryTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	transport.lock.Lock()
+	listener, ok := transport.listeners[addr]
+	localAddr := transport.newAddr()
+	transport.lock.Unlock()
+	if !ok {
+		return nil, errors.New("Connection refused")
+	}
+
+	local, remote := net.Pipe()
+	select {
+	case listener.conns <- &memoryConn{remote, memoryAddr(addr), localAddr}:
+		return &memoryConn{local, localAddr, memoryAddr(addr)}, nil
+	case <-listener.done:
+		local.Close()
+		remote.Close()
+		return nil, errors.New("Connection refused")
+	case <-time.After(timeout):
+		// the listener is not accepting connections
+		local.Close()
+		remote.Close()
+		return nil, errors.New("Connection timed out")
+	}
+}
+
+func (transport *MemoryTransport) ValidateAddr(addr string) error {
+	if !strings.HasPrefix(addr, memoryPrefix) {
+		return errors.New("Invalid memory address")
+	}
+	return nil
+}
+
+type memoryAddr string
+
+func (addr memoryAddr) Network() string { return "memory" }
+func (addr memoryAddr) String() string  { return string(addr) }
+
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      memoryAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (listener *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *memoryListener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.done)
+		listener.transport.lock.Lock()
+		delete(listener.transport.listeners, string(listener.addr))
+		listener.transport.lock.Unlock()
+	})
+	return nil
+}
+
+func (listener *memoryListener) Addr() net.Addr {
+	return listener.addr
+}
+
+// a net.Pipe end with the addresses of the listener and the dialer
+type memoryConn struct {
+	net.Conn
+	localAddr  memoryAddr
+	remoteAddr memoryAddr
+}
+
+func (conn *memoryConn) LocalAddr() net.Addr  { return conn.localAddr }
+func (conn *memoryConn) RemoteAddr() net.Addr { return conn.remoteAddr }
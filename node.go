@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"crypto/rsa"
 	"encoding/hex"
+	"sync"
+	"time"
 
 	"github.com/impadalko/CES27Projeto/blockchain"
 	"github.com/impadalko/CES27Projeto/network"
+	"github.com/impadalko/CES27Projeto/sign"
 	"github.com/impadalko/CES27Projeto/util"
 )
 
@@ -18,93 +23,449 @@ type Node struct {
 	KeyName    string
 	PrivateKey *rsa.PrivateKey
 	PublicKey  *rsa.PublicKey
-}
 
-var node Node // FIXME find some way to share the node between handlers without global...
+	// data of the blocks orphaned by a reorganization of the blockchain, they are added
+	// again to the blockchain
+	Pending     [][]byte
+	PendingLock sync.Mutex
+
+	// hashes of the data of the blocks added by the current node, only the author of an
+	// orphaned block adds its data again
+	Authored *network.SeenCache
+
+	// map: topic string => subscription made with the subscribe command
+	Subscriptions map[string]*network.Subscription
+
+	// direct messages, see direct.go
+	Identity   *rsa.PrivateKey           // identity key, direct messages can't be sent when nil
+	PeerKeys   map[string]*rsa.PublicKey // map: peerId string => identity key of the peer
+	Inbox      []InboxMessage
+	InboxLock  sync.Mutex         // protects PeerKeys and Inbox
+	DirectSeen *network.SeenCache // ids of the direct messages already received
+
+	// permissioned membership, see membership.go
+	AdminKey *rsa.PublicKey                 // only members may connect when set
+	Auth     map[*network.ConnInfo]*peerAuth // authentication of the peers
+	AuthLock sync.Mutex
+}
 
 func NewNode(nodeId string) *Node {
-	node = Node{
-		network.NewNode(nodeId),
-		&blockchain.BlockChain{},
-		"",		
-		nil,
-		nil,
+	node := &Node{
+		Network:    network.NewNode(nodeId),
+		BlockChain: &blockchain.BlockChain{},
+
+		Subscriptions: map[string]*network.Subscription{},
+
+		PeerKeys: map[string]*rsa.PublicKey{},
+
+		Auth: map[*network.ConnInfo]*peerAuth{},
+	}
+	node.DirectSeen = network.NewSeenCache(node.Network.Config.SeenCacheSize)
+	node.Authored = network.NewSeenCache(node.Network.Config.SeenCacheSize)
+	// the handlers are bound to the node, so they can share it without a global
+	node.Network.AddHandler(network.MessageDef{
+		New:    func() network.Message { return &RequestBlockchain{} },
+		Handle: node.HandleRequestBlockchain,
+	})
+	node.Network.AddHandler(network.MessageDef{
+		New:      func() network.Message { return &BlockAdd{} },
+		Validate: ValidateBlockAdd,
+		Handle:   node.HandleBlockAddMessage,
+	})
+	node.Network.AddHandler(network.MessageDef{
+		New:      func() network.Message { return &Blocks{} },
+		Validate: ValidateBlocks,
+		Handle:   node.HandleBlocks,
+	})
+	node.Network.AddHandler(network.MessageDef{
+		New:      func() network.Message { return &Tip{} },
+		Validate: ValidateTip,
+		Handle:   node.HandleTip,
+	})
+	node.Network.AddHandler(network.MessageDef{
+		New:      func() network.Message { return &GetBlocks{} },
+		Validate: ValidateGetBlocks,
+		Handle:   node.HandleGetBlocks,
+	})
+	node.Network.AddHandler(network.MessageDef{
+		New:      func() network.Message { return &Identity{} },
+		Validate: ValidateIdentity,
+		Handle:   node.HandleIdentity,
+	})
+	node.Network.AddHandler(network.MessageDef{
+		New:      func() network.Message { return &Direct{} },
+		Validate: ValidateDirect,
+		Handle:   node.HandleDirect,
+	})
+	node.Network.AddHandler(network.MessageDef{
+		New:      func() network.Message { return &AuthChallenge{} },
+		Validate: ValidateAuthChallenge,
+		Handle:   node.HandleAuthChallenge,
+	})
+	node.Network.AddHandler(network.MessageDef{
+		New:      func() network.Message { return &Auth{} },
+		Validate: ValidateAuth,
+		Handle:   node.HandleAuth,
+	})
+	node.Network.Use(node.AuthMiddleware)
+	// observers receive blocks but can't submit them
+	node.Network.DenyObservers("BLOCK-ADD", "BLOCKS")
+	node.Network.AddInventory(network.Inventory{
+		Kind: InventoryBlock,
+		Has:  node.HasBlock,
+		Get:  node.GetBlockMessage,
+	})
+	node.Network.ChainInfo = node.ChainInfo
+	node.Network.OnHandshake = node.HandleHandshake
+	node.Network.Authorized = node.Authorized
+	return node
+}
+
+// in a permissioned network the new peer must authenticate first, see membership.go
+func (node *Node) HandleHandshake(connInfo *network.ConnInfo) {
+	if node.Permissioned() {
+		node.Challenge(connInfo)
+		return
+	}
+	node.Greet(connInfo)
+}
+
+// sends the identity key to a new peer and compares the blockchains of both nodes. Peers
+// that don't support TIP only send their height, and their blockchain is requested if
+// it is longer
+func (node *Node) Greet(connInfo *network.ConnInfo) {
+	if node.Permissioned() {
+		// the peer could not learn them before it was verified
+		node.Network.Introduce(connInfo)
+	}
+	if node.Identity != nil && connInfo.Supports("IDENTITY") {
+		connInfo.SendMessage(&Identity{sign.PublicKeyToBytes(&node.Identity.PublicKey)})
+	}
+	if connInfo.Supports("TIP") {
+		connInfo.SendMessage(node.Tip())
+		return
 	}
-	node.Network.AddHandler("REQUEST-BLOCKCHAIN", HandleRequestBlockchain)
-	node.Network.AddHandler("BLOCK-ADD", HandleBlockAddMessage)
-	return &node
+	_, height := node.ChainInfo()
+	if connInfo.GetHello().Height > height {
+		node.RequestBlockchain(connInfo)
+	}
+}
+
+func (node *Node) Tip() *Tip {
+	nextIndex, _ := node.BlockChain.Tip()
+	lastId, ok := node.BlockChain.LastId()
+	if !ok {
+		return &Tip{0, []byte{}}
+	}
+	return &Tip{nextIndex, lastId[:]}
+}
+
+func (node *Node) HandleTip(ctx *network.Context, msg network.Message) error {
+	// the peer sent the last block of its blockchain, the blocks the current node is
+	// missing are requested if fork choice prefers the blockchain of the peer
+	tip := msg.(*Tip)
+	if len(tip.LastId) == 0 {
+		return nil
+	}
+	peerLastId := blockchain.HashVal{}
+	copy(peerLastId[:], tip.LastId)
+	nextIndex, _ := node.BlockChain.Tip()
+	lastId, _ := node.BlockChain.LastId()
+	if peerLastId != lastId && blockchain.Prefer(tip.NextIndex, peerLastId, nextIndex, lastId) {
+		node.RequestBlockchain(ctx.ConnInfo)
+	}
+	return nil
 }
 
-func HandleRequestBlockchain(connInfo *network.ConnInfo, args []string) {
+// requests the blockchain of the peer of the connection without blocking. Blockchains
+// are never requested from observers, since they can't submit blocks
+func (node *Node) RequestBlockchain(connInfo *network.ConnInfo) {
+	if connInfo.IsObserver() {
+		return
+	}
+	peerId, _ := connInfo.GetPeer()
+	if connInfo.Supports("GET-BLOCKS") {
+		// only the blocks after the last block in common are requested
+		go func(peerId string) {
+			err := node.SyncBlocks(peerId)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}(peerId)
+	} else if connInfo.Supports("CALL") {
+		// the reply is read by the goroutine handling this connection, so the call
+		// can't block it
+		go func(peerId string) {
+			err := node.SyncBlockchain(peerId)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}(peerId)
+	} else if connInfo.Supports("REQUEST-BLOCKCHAIN") {
+		connInfo.SendMessage(&RequestBlockchain{})
+	}
+}
+
+// inventory kind of the blocks of the blockchain, identified by Block.Id
+const InventoryBlock = "BLOCK"
+
+func (node *Node) HasBlock(hash string) bool {
+	_, ok := node.GetBlockMessage(hash)
+	return ok
+}
+
+func (node *Node) GetBlockMessage(hash string) (network.Message, bool) {
+	id, err := blockchain.HashValFromString(hash)
+	if err != nil {
+		return nil, false
+	}
+	block, ok := node.BlockChain.FindBlock(id)
+	if !ok {
+		return nil, false
+	}
+	return &BlockAdd{block}, true
+}
+
+// announces a block of the blockchain to the peers that don't have it
+func (node *Node) AnnounceBlock(block blockchain.Block) {
+	node.Network.Announce(InventoryBlock, block.Id().String())
+}
+
+func (node *Node) ChainInfo() (string, int64) {
+	chainId, ok := node.BlockChain.ChainId()
+	if !ok {
+		return network.NoChainId, 0
+	}
+	nextIndex, _ := node.BlockChain.Tip()
+	return chainId.String(), nextIndex
+}
+
+func (node *Node) HandleRequestBlockchain(ctx *network.Context, msg network.Message) error {
 	// the peer requested for all the blocks of the blockchain of the current node to be sent back
+	if !ctx.ConnInfo.Supports("BLOCK-ADD") {
+		return errors.New("Peer does not support BLOCK-ADD")
+	}
 	node.BlockChain.Lock.RLock()
+	defer node.BlockChain.Lock.RUnlock()
 	for _, block := range node.BlockChain.Blocks {
-		msg := fmt.Sprintf("BLOCK-ADD %s\n", block.String())
-		connInfo.SendMessage(msg)
+		ctx.ConnInfo.MarkKnown(InventoryBlock, block.Id().String())
 	}
-	node.BlockChain.Lock.RUnlock()
+	if ctx.RequestId != 0 {
+		// the peer is waiting for all the blocks in a single reply
+		blocks := append([]blockchain.Block{}, node.BlockChain.Blocks...)
+		return ctx.Reply(&Blocks{blocks})
+	}
+	for _, block := range node.BlockChain.Blocks {
+		ctx.Reply(&BlockAdd{block})
+	}
+	return nil
 }
 
-func HandleBlockAddMessage(connInfo *network.ConnInfo, args []string) {
-	// FIXME node.BlockChain must be handled with mutexes
+func (node *Node) HandleBlocks(ctx *network.Context, msg network.Message) error {
+	// the peer sent its full blockchain
+	blocks := msg.(*Blocks).Blocks
+	for _, block := range blocks {
+		ctx.ConnInfo.MarkKnown(InventoryBlock, block.Id().String())
+	}
+	peerId, _ := ctx.ConnInfo.GetPeer()
+	err := node.ReceiveBranch(peerId, blocks)
+	if err != nil {
+		ctx.Misbehave(network.ScoreInvalidBlock, err.Error())
+	}
+	return err
+}
 
-	// the peer sent a block to be added to the blockchain of the current node
-	block, err := blockchain.BlockFromString(args[1])
+func (node *Node) HandleGetBlocks(ctx *network.Context, msg network.Message) error {
+	// the peer requested the blocks that follow the last block both nodes have
+	blocks := node.BlockChain.BlocksAfter(msg.(*GetBlocks).Locator, MaxBlocksPerReply)
+	for _, block := range blocks {
+		ctx.ConnInfo.MarkKnown(InventoryBlock, block.Id().String())
+	}
+	return ctx.Reply(&Blocks{blocks})
+}
+
+// requests the blocks of a peer after the last block both nodes have, and switches to
+// them if fork choice prefers them
+func (node *Node) SyncBlocks(peerId string) error {
+	locator := node.BlockChain.Locator()
+	branch := []blockchain.Block{}
+	for requests := 0; ; requests++ {
+		if requests == MaxSyncRequests {
+			return fmt.Errorf("Sync with %s exceeded %d requests", peerId, MaxSyncRequests)
+		}
+		reply, err := node.Network.Call(context.Background(), peerId, &GetBlocks{locator})
+		if err != nil {
+			return err
+		}
+		blocks, ok := reply.(*Blocks)
+		if !ok {
+			return errors.New("Unexpected reply to GET-BLOCKS")
+		}
+		branch = append(branch, blocks.Blocks...)
+		if len(blocks.Blocks) < MaxBlocksPerReply {
+			break
+		}
+		// the next blocks of the branch are requested from its last block
+		locator = []blockchain.HashVal{branch[len(branch)-1].Id()}
+	}
+	return node.ReceiveBranch(peerId, branch)
+}
+
+// requests the blockchain of a peer and waits for it
+func (node *Node) SyncBlockchain(peerId string) error {
+	reply, err := node.Network.Call(context.Background(), peerId, &RequestBlockchain{})
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
+	}
+	blocks, ok := reply.(*Blocks)
+	if !ok {
+		return errors.New("Unexpected reply to REQUEST-BLOCKCHAIN")
+	}
+	return node.ReceiveBranch(peerId, blocks.Blocks)
+}
+
+// switches the blockchain of the current node to the branch that ends with @blocks,
+// received from the peer @peerId, if fork choice prefers it. The data of the blocks left
+// out of the new blockchain that the current node added goes to the pending pool and is
+// added again to the blockchain, the other nodes leave it to the author of each block
+func (node *Node) ReceiveBranch(peerId string, blocks []blockchain.Block) error {
+	contributed := 0
+	for _, block := range blocks {
+		if own, err := node.BlockChain.GetBlock(block.Index); err != nil || own.Id() != block.Id() {
+			contributed++
+		}
+	}
+	orphaned, switched, err := node.BlockChain.Reorganize(blocks)
+	if err != nil || !switched {
+		return err
+	}
+	if connInfo, ok := node.Network.GetPeerConn(peerId); ok {
+		connInfo.AddBlocksContributed(contributed)
+	}
+	fmt.Println("Blockchain replaced:")
+	node.PrintBlocks()
+	node.CheckMembers()
+
+	// announce the new last block, peers that are behind will sync from it
+	node.AnnounceBlock(blocks[len(blocks)-1])
+
+	if node.Network.IsObserver() {
+		// observers can't add the orphaned data again
+		return nil
+	}
+	for _, block := range orphaned {
+		if block.Index > 0 && node.Authored.Has(block.Hash().String()) {
+			node.AddPending(block.Data)
+		}
+	}
+	return node.FlushPending()
+}
+
+func (node *Node) AddPending(data []byte) {
+	node.PendingLock.Lock()
+	node.Pending = append(node.Pending, data)
+	node.PendingLock.Unlock()
+}
+
+// adds the pending data that is not in the blockchain yet as new blocks
+func (node *Node) FlushPending() error {
+	node.PendingLock.Lock()
+	defer node.PendingLock.Unlock()
+	for len(node.Pending) > 0 {
+		data := node.Pending[0]
+		if !node.BlockChain.HasData(data) {
+			index, err := node.AddBlockFromData(util.Now(), data)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Pending data added again in block %d\n\n", index)
+		}
+		node.Pending = node.Pending[1:]
 	}
+	return nil
+}
+
+func (node *Node) HandleBlockAddMessage(ctx *network.Context, msg network.Message) error {
+	// the peer sent a block to be added to the blockchain of the current node
+	block := msg.(*BlockAdd).Block
+	ctx.ConnInfo.MarkKnown(InventoryBlock, block.Id().String())
+	nextIndex, lastHash := node.BlockChain.Tip()
 	if block.Index == 0 {
 
-		// replace the blockchain of the current node with and empty blockchain
-		// starting with the received block
-		node.BlockChain = blockchain.NewFromBlock(block)
+		// a node without blockchain starts one with the received block, otherwise the
+		// blockchain is never replaced and a genesis block of another chain is invalid
+		genesis, err := node.BlockChain.GetBlock(0)
+		if err != nil {
+			peerId, _ := ctx.ConnInfo.GetPeer()
+			return node.ReceiveBranch(peerId, []blockchain.Block{block})
+		}
+		if genesis.Id() != block.Id() {
+			ctx.Misbehave(network.ScoreInvalidBlock, "genesis block of another chain")
+			return errors.New("Genesis block of another chain")
+		}
+
+	} else if block.Index == nextIndex && block.PreviousHash == lastHash {
+
+		// add the new block to the end of the blockchain of the current node
+		_, err := node.BlockChain.AddBlock(block)
+		if err != nil {
+			ctx.Misbehave(network.ScoreInvalidBlock, err.Error())
+			return err
+		}
+		ctx.ConnInfo.AddBlocksContributed(1)
 		hexData := util.Prefix(hex.EncodeToString(block.Data))
 		fmt.Println("Block added:")
 		fmt.Printf("%5s %-8s %-8s %-10s %s\n", "Index", "Hash", "PrevHash", "Timestamp", "Data")
 		fmt.Printf("%5d %8s %8s %10d %s\n", block.Index, block.Hash().String()[:8],
 			block.PreviousHash.String()[:8], block.Timestamp, hexData)
 		fmt.Println()
+		node.CheckMembers()
 
-	} else if block.Index == node.BlockChain.NextIndex &&
-		block.PreviousHash == node.BlockChain.LastHash {
-
-		// add the new block to the end of the blockchain of the current node
-		_, err = node.BlockChain.AddBlock(block)
-		if err != nil {
-			fmt.Println(err)
-		} else {
-			hexData := util.Prefix(hex.EncodeToString(block.Data))
-			fmt.Println("Block added:")
-			fmt.Printf("%5s %-8s %-8s %-10s %s\n", "Index", "Hash", "PrevHash", "Timestamp", "Data")
-			fmt.Printf("%5d %8s %8s %10d %s\n", block.Index, block.Hash().String()[:8],
-				block.PreviousHash.String()[:8], block.Timestamp, hexData)
-			fmt.Println()
-		}
+		// relay the block to the other peers. Peers that already know the block are
+		// skipped and blocks already in the blockchain are never added again, so the
+		// block does not loop between peers
+		node.Network.AnnounceExcept(InventoryBlock, block.Id().String(), ctx.ConnInfo)
 
-	} else if block.Index >= node.BlockChain.NextIndex {
+	} else if block.Index >= nextIndex {
 
 		fmt.Println("WARNING: Refreshing blockchain")
 		fmt.Println()
 
 		// the current node is behind the blockchain of the peer,
 		// so request peer to send the full blockchain
-		connInfo.SendMessage("REQUEST-BLOCKCHAIN\n")
+		node.RequestBlockchain(ctx.ConnInfo)
+
+	} else if _, ok := node.BlockChain.FindBlock(block.Id()); !ok {
+
+		// the block belongs to a branch that is not longer than the blockchain of the
+		// current node, the peer switches to this blockchain once it learns about it
+		hexData := util.Prefix(hex.EncodeToString(block.Data))
+		fmt.Println("WARNING: Ignored block of another branch:")
+		fmt.Printf("%5s %-8s %-8s %-10s %s\n", "Index", "Hash", "PrevHash", "Timestamp", "Data")
+		fmt.Printf("%5d %8s %8s %10d %s\n", block.Index, block.Hash().String()[:8],
+			block.PreviousHash.String()[:8], block.Timestamp, hexData)
+		fmt.Println()
+		node.RequestBlockchain(ctx.ConnInfo)
 
 	} else {
+		// blocks the current node already has are ignored without penalty, honest peers
+		// send them when several peers answer GETDATA for the same block
 		hexData := util.Prefix(hex.EncodeToString(block.Data))
 		fmt.Println("WARNING: Ignored invalid block:")
 		fmt.Printf("%5s %-8s %-8s %-10s %s\n", "Index", "Hash", "PrevHash", "Timestamp", "Data")
 			fmt.Printf("%5d %8s %8s %10d %s\n", block.Index, block.Hash().String()[:8],
 				block.PreviousHash.String()[:8], block.Timestamp, hexData)
 		fmt.Println()
-		
 	}
+	return nil
 }
 
 func (node *Node) PrintInfo() {
 	fmt.Println("NodeId:  ", node.Network.NodeId)
 	fmt.Println("NodeAddr:", node.Network.NodeAddr)
+	if node.Network.IsObserver() {
+		fmt.Println("Role:     observer")
+	}
 	fmt.Println()
 }
 
@@ -114,15 +475,39 @@ func (node *Node) PrintPeers() {
 		fmt.Println("No Peers")
 		fmt.Println()
 	} else {
-		fmt.Printf("%-10s %s\n", "PeerId", "PeerAddr")
+		fmt.Printf("%-10s %-22s %-8s %s\n", "PeerId", "PeerAddr", "Role", "Latency")
 		for _, peer := range node.Network.Peers {
-			fmt.Printf("%-10s %s\n", peer.Id, peer.Addr)
+			latency, role := "-", "full"
+			if connInfo, ok := node.Network.GetConn(peer.Conn); ok {
+				if connInfo.GetRTT() > 0 {
+					latency = connInfo.GetRTT().String()
+				}
+				if connInfo.IsObserver() {
+					role = "observer"
+				}
+			}
+			fmt.Printf("%-10s %-22s %-8s %s\n", peer.Id, peer.Addr, role, latency)
 		}
 		fmt.Println()
 	}
 	node.Network.PeersLock.RUnlock()
 }
 
+func (node *Node) PrintBanList() {
+	entries := node.Network.BanList.List()
+	if len(entries) == 0 {
+		fmt.Println("No Bans")
+		fmt.Println()
+		return
+	}
+	fmt.Printf("%-40s %-20s %s\n", "Target", "Until", "Reason")
+	for _, entry := range entries {
+		until := time.Unix(entry.Until, 0).Format("2006-01-02 15:04:05")
+		fmt.Printf("%-40s %-20s %s\n", entry.Target, until, entry.Reason)
+	}
+	fmt.Println()
+}
+
 func (node *Node) PrintConns() {
 	node.Network.ConnsLock.RLock()
 	if len(node.Network.Conns) == 0 {
@@ -131,19 +516,101 @@ func (node *Node) PrintConns() {
 	} else {
 		fmt.Printf("%-22s %-22s %-10s %s\n", "RemoteAddr", "LocalAddr", "PeerId", "PeerAddr")
 		for _, conn := range node.Network.Conns {
+			peerId, peerAddr := conn.GetPeer()
 			fmt.Printf("%-22s %-22s %-10s %s\n",
-				conn.Conn.RemoteAddr().String(), conn.Conn.LocalAddr().String(), conn.PeerId, conn.PeerAddr)
+				conn.Conn.RemoteAddr().String(), conn.Conn.LocalAddr().String(), peerId, peerAddr)
 		}
 		fmt.Println()
 	}
 	node.Network.ConnsLock.RUnlock()
 }
 
+// subscribes to @topic and prints the messages received on it
+func (node *Node) Subscribe(topic string) error {
+	if _, ok := node.Subscriptions[topic]; ok {
+		return errors.New("Already subscribed to " + topic)
+	}
+	sub, err := node.Network.Subscribe(topic)
+	if err != nil {
+		return err
+	}
+	node.Subscriptions[topic] = sub
+	go func() {
+		for publication := range sub.C {
+			fmt.Printf("Message on %s from %s: %s\n\n", publication.Topic, publication.Origin, publication.Data)
+		}
+	}()
+	return nil
+}
+
+func (node *Node) Unsubscribe(topic string) error {
+	sub, ok := node.Subscriptions[topic]
+	if !ok {
+		return errors.New("Not subscribed to " + topic)
+	}
+	sub.Unsubscribe()
+	delete(node.Subscriptions, topic)
+	return nil
+}
+
+func (node *Node) PrintNetStats() {
+	stats := node.Network.Stats()
+	if len(stats) == 0 {
+		fmt.Println("No Connections")
+		fmt.Println()
+		return
+	}
+	fmt.Printf("%-10s %-3s %-8s %-8s %-10s %8s %10s %8s %10s %-6s %s\n", "PeerId", "Dir", "Age", "LastMsg",
+		"Latency", "MsgIn", "BytesIn", "MsgOut", "BytesOut", "Blocks", "Compression")
+	for _, conn := range stats {
+		direction := "in"
+		if conn.Outbound {
+			direction = "out"
+		}
+		lastMessage := "-"
+		if !conn.LastMessage.IsZero() {
+			lastMessage = time.Since(conn.LastMessage).Round(time.Second).String()
+		}
+		latency := "-"
+		if conn.RTT > 0 {
+			latency = conn.RTT.Round(time.Microsecond).String()
+		}
+		// ratio of all the compressed messages, received and sent
+		compressed := network.CompressionStats{
+			Bytes:    conn.CompressedIn.Bytes + conn.CompressedOut.Bytes,
+			RawBytes: conn.CompressedIn.RawBytes + conn.CompressedOut.RawBytes,
+		}
+		compression := "-"
+		if compressed.Bytes > 0 {
+			compression = fmt.Sprintf("%.2fx", compressed.Ratio())
+		}
+		fmt.Printf("%-10s %-3s %-8s %-8s %-10s %8d %10d %8d %10d %-6d %s\n", conn.PeerId, direction,
+			conn.Age().Round(time.Second), lastMessage, latency, conn.In.Messages, conn.In.Bytes,
+			conn.Out.Messages, conn.Out.Bytes, conn.BlocksContributed, compression)
+	}
+	fmt.Println()
+}
+
+// adds a new block to the blockchain and announces it to the peers
 func (node *Node) AddBlockFromData(timestamp int64, data []byte) (int64, error) {
-	return node.BlockChain.AddBlockFromData(timestamp, data)
+	if node.Network.IsObserver() {
+		return 0, network.ErrObserver
+	}
+	index, err := node.BlockChain.AddBlockFromData(timestamp, data)
+	if err != nil {
+		return index, err
+	}
+	block, err := node.BlockChain.GetBlock(index)
+	if err != nil {
+		return index, err
+	}
+	node.Authored.Add(block.Hash().String())
+	node.AnnounceBlock(block)
+	node.CheckMembers()
+	return index, nil
 }
 
-func (node *Node) Broadcast(msg string) {
+func (node *Node) Broadcast(msg network.Message) {
 	node.Network.Broadcast(msg)
 }
 
@@ -159,6 +626,16 @@ func (node *Node) StartHandleConnection(conn net.Conn) {
 	node.Network.StartHandleConnection(conn)
 }
 
+// notifies the peers that the node is leaving and closes all the connections
+func (node *Node) Leave() {
+	fmt.Println("Leaving the network")
+	fmt.Println()
+	err := node.Network.Shutdown()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
 func (node *Node) Start() {
 	node.Network.Start()
 }
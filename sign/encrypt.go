@@ -0,0 +1,94 @@
+package sign
+
+// Hybrid encryption of messages to the owner of a public key. RSA alone only encrypts
+// a few hundred bytes, so the data is encrypted with a random AES-256-GCM key, and only
+// that key is encrypted with RSA-OAEP:
+//
+//     <length of the encrypted key: 2 bytes> <encrypted key> <nonce> <encrypted data>
+
+import (
+    "encoding/binary"
+    "errors"
+
+    // Cryptographically secure random number generator
+    "crypto/rand"
+
+    // Public/private key cryptography implementation
+    "crypto/rsa"
+
+    // Symmetric encryption of the data
+    "crypto/aes"
+    "crypto/cipher"
+
+    "crypto/sha256"
+)
+
+const symmetricKeySize = 32 // bytes, AES-256
+
+// Encrypts @data so that only the owner of the private key of @pubKey can read it
+func Encrypt(pubKey *rsa.PublicKey, data []byte) ([]byte, error) {
+    key := make([]byte, symmetricKeySize)
+    _, err := rand.Read(key)
+    if err != nil {
+        return nil, err
+    }
+
+    // func rsa.EncryptOAEP(hash hash.Hash, random io.Reader, pub *rsa.PublicKey, msg []byte, label []byte) ([]byte, error)
+    encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pubKey, key, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    gcm, err := newGCM(key)
+    if err != nil {
+        return nil, err
+    }
+    nonce := make([]byte, gcm.NonceSize())
+    _, err = rand.Read(nonce)
+    if err != nil {
+        return nil, err
+    }
+
+    out := make([]byte, 2, 2+len(encryptedKey)+len(nonce)+len(data)+gcm.Overhead())
+    binary.BigEndian.PutUint16(out, uint16(len(encryptedKey)))
+    out = append(out, encryptedKey...)
+    out = append(out, nonce...)
+    return gcm.Seal(out, nonce, data, nil), nil
+}
+
+// Decrypts @encrypted, the output of Encrypt with the public key of @privKey
+func Decrypt(privKey *rsa.PrivateKey, encrypted []byte) ([]byte, error) {
+    if len(encrypted) < 2 {
+        return nil, errors.New("Encrypted data too short")
+    }
+    keyLen := int(binary.BigEndian.Uint16(encrypted))
+    encrypted = encrypted[2:]
+    if len(encrypted) < keyLen {
+        return nil, errors.New("Encrypted data too short")
+    }
+
+    // func rsa.DecryptOAEP(hash hash.Hash, random io.Reader, priv *rsa.PrivateKey, ciphertext []byte, label []byte) ([]byte, error)
+    key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privKey, encrypted[:keyLen], nil)
+    if err != nil {
+        return nil, err
+    }
+    encrypted = encrypted[keyLen:]
+
+    gcm, err := newGCM(key)
+    if err != nil {
+        return nil, err
+    }
+    if len(encrypted) < gcm.NonceSize() {
+        return nil, errors.New("Encrypted data too short")
+    }
+    nonce := encrypted[:gcm.NonceSize()]
+    return gcm.Open(nil, nonce, encrypted[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
@@ -149,3 +149,13 @@ func PublicKeyFromPemFile(filename string) (*rsa.PublicKey, error) {
 
     return rsaPubKey, nil
 }
+
+// Encodes @pubKey to be sent to other nodes
+func PublicKeyToBytes(pubKey *rsa.PublicKey) []byte {
+    return x509.MarshalPKCS1PublicKey(pubKey)
+}
+
+// Decodes a public key encoded with PublicKeyToBytes
+func PublicKeyFromBytes(bytes []byte) (*rsa.PublicKey, error) {
+    return x509.ParsePKCS1PublicKey(bytes)
+}
@@ -1,11 +1,11 @@
 package sign
 
 type TestError struct {
-    msg string
+	msg string
 }
 
 func (err *TestError) Error() string {
-    return err.msg
+	return err.msg
 }
 
 func TestWriteAndReadPemFile() error {
@@ -14,7 +14,7 @@ func TestWriteAndReadPemFile() error {
 		return err
 	}
 	pubKey := &privKey.PublicKey
-	
+
 	err = WritePrivateKeyToPemFile(privKey, "priv_key.pem")
 	if err != nil {
 		return err
@@ -23,29 +23,29 @@ func TestWriteAndReadPemFile() error {
 	err = WritePublicKeyToPemFile(pubKey, "pub_key.pem")
 	if err != nil {
 		return err
-    }
+	}
 
-    readPrivKey, err := PrivateKeyFromPemFile("priv_key.pem")
-    if err != nil {
+	readPrivKey, err := PrivateKeyFromPemFile("priv_key.pem")
+	if err != nil {
 		return err
-    }
+	}
 
-    if readPrivKey.D.Cmp(privKey.D) != 0 ||
-        readPrivKey.PublicKey.N.Cmp(privKey.PublicKey.N) != 0 ||
-        readPrivKey.PublicKey.E != privKey.PublicKey.E {
-        return &TestError{"Error reading private key from file"}
-    }
+	if readPrivKey.D.Cmp(privKey.D) != 0 ||
+		readPrivKey.PublicKey.N.Cmp(privKey.PublicKey.N) != 0 ||
+		readPrivKey.PublicKey.E != privKey.PublicKey.E {
+		return &TestError{"Error reading private key from file"}
+	}
 
-    readPubKey, err := PublicKeyFromPemFile("pub_key.pem")
-    if err != nil {
+	readPubKey, err := PublicKeyFromPemFile("pub_key.pem")
+	if err != nil {
 		return err
-    }
+	}
 
-    if readPubKey.N.Cmp(pubKey.N) != 0 || readPubKey.E != pubKey.E {
-        return &TestError{"Error reading public key from file"}
-    }
+	if readPubKey.N.Cmp(pubKey.N) != 0 || readPubKey.E != pubKey.E {
+		return &TestError{"Error reading public key from file"}
+	}
 
-    return nil
+	return nil
 }
 
 func TestSignAndVerify() error {
@@ -69,4 +69,39 @@ func TestSignAndVerify() error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+func TestEncryptAndDecrypt() error {
+	privKey, err := GenerateKey()
+	if err != nil {
+		return err
+	}
+	pubKey, err := PublicKeyFromBytes(PublicKeyToBytes(&privKey.PublicKey))
+	if err != nil {
+		return err
+	}
+
+	data := []byte("Hello World!")
+	encrypted, err := Encrypt(pubKey, data)
+	if err != nil {
+		return err
+	}
+	decrypted, err := Decrypt(privKey, encrypted)
+	if err != nil {
+		return err
+	}
+	if string(decrypted) != string(data) {
+		return &TestError{"Decrypted data mismatch"}
+	}
+
+	otherKey, err := GenerateKey()
+	if err != nil {
+		return err
+	}
+	_, err = Decrypt(otherKey, encrypted)
+	if err == nil {
+		return &TestError{"Expected decryption with another key to fail"}
+	}
+
+	return nil
+}
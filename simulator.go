@@ -0,0 +1,289 @@
+package main
+
+// In-process network simulator.
+//
+// The simulator runs several nodes in the current process, connected through an
+// in-memory transport. Each link between two nodes may delay and drop the messages
+// written on it, and the nodes may be split in partitions that can't communicate until
+// the partitions are healed.
+//
+// Messages are written in a single write each, so dropping a write drops exactly one
+// message and the rest of the stream stays readable.
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/impadalko/CES27Projeto/blockchain"
+	"github.com/impadalko/CES27Projeto/network"
+	"github.com/impadalko/CES27Projeto/util"
+)
+
+type Link struct {
+	Latency time.Duration
+	Loss    float64 // probability of dropping each message
+}
+
+type Simulator struct {
+	Nodes     []*Node
+	Transport *network.MemoryTransport
+
+	// map: [from, to] node addresses => link, DefaultLink is used for the other links
+	links       map[[2]string]Link
+	DefaultLink Link
+
+	// map: node address => partition, nodes in different partitions can't communicate
+	partitions map[string]int
+
+	// map: address of the dialing end of a connection => address of the dialing node
+	dialers map[string]string
+
+	lock sync.RWMutex
+}
+
+// starts @size nodes with @config connected to each other, the first node creates the
+// blockchain and is the seed of the others
+func NewSimulator(size int, config network.Config) (*Simulator, error) {
+	sim := &Simulator{
+		Transport:  network.NewMemoryTransport(),
+		links:      map[[2]string]Link{},
+		partitions: map[string]int{},
+		dialers:    map[string]string{},
+	}
+	for i := 0; i < size; i++ {
+		node := NewNode(fmt.Sprintf("node%d", i))
+		node.Network.SetConfig(config)
+		node.Network.Transport = &simTransport{sim: sim}
+		if i > 0 {
+			node.Network.Config.Seeds = []string{sim.Nodes[0].Network.NodeAddr}
+		}
+		err := node.Listen()
+		if err != nil {
+			return nil, err
+		}
+		sim.Nodes = append(sim.Nodes, node)
+	}
+	sim.Nodes[0].BlockChain.Replace(blockchain.New(util.Now(), []byte{}))
+
+	for _, node := range sim.Nodes {
+		go node.Start()
+		go node.Network.StartConnectionManager()
+		go node.Network.StartHeartbeat()
+		go node.Network.StartAddrGossip()
+	}
+	return sim, nil
+}
+
+func (sim *Simulator) Stop() {
+	for _, node := range sim.Nodes {
+		node.Network.Shutdown()
+	}
+}
+
+// sets the link between the nodes @a and @b, in both directions
+func (sim *Simulator) SetLink(a int, b int, link Link) {
+	addrA, addrB := sim.Nodes[a].Network.NodeAddr, sim.Nodes[b].Network.NodeAddr
+	sim.lock.Lock()
+	sim.links[[2]string{addrA, addrB}] = link
+	sim.links[[2]string{addrB, addrA}] = link
+	sim.lock.Unlock()
+}
+
+// splits the nodes in @groups of node indexes, the nodes not in any group are
+// isolated from all the others
+func (sim *Simulator) Partition(groups ...[]int) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	for i, node := range sim.Nodes {
+		sim.partitions[node.Network.NodeAddr] = len(groups) + i
+	}
+	for partition, group := range groups {
+		for _, i := range group {
+			sim.partitions[sim.Nodes[i].Network.NodeAddr] = partition
+		}
+	}
+}
+
+// removes all the partitions
+func (sim *Simulator) Heal() {
+	sim.lock.Lock()
+	sim.partitions = map[string]int{}
+	sim.lock.Unlock()
+}
+
+// the link from the node at @from to the node at @to, false if they can't communicate
+func (sim *Simulator) link(from string, to string) (Link, bool) {
+	sim.lock.RLock()
+	defer sim.lock.RUnlock()
+	if dialer, ok := sim.dialers[to]; ok {
+		to = dialer
+	}
+	if sim.partitions[from] != sim.partitions[to] {
+		return Link{}, false
+	}
+	if link, ok := sim.links[[2]string{from, to}]; ok {
+		return link, true
+	}
+	return sim.DefaultLink, true
+}
+
+func (sim *Simulator) AddBlock(node int, data []byte) error {
+	_, err := sim.Nodes[node].AddBlockFromData(util.Now(), data)
+	return err
+}
+
+// whether the node @a has the node @b as peer or the other way around
+func (sim *Simulator) Connected(a int, b int) bool {
+	_, okA := sim.Nodes[a].Network.GetPeer(sim.Nodes[b].Network.NodeId)
+	_, okB := sim.Nodes[b].Network.GetPeer(sim.Nodes[a].Network.NodeId)
+	return okA || okB
+}
+
+// whether all the nodes have the same blockchain
+func (sim *Simulator) Converged() bool {
+	nextIndex, lastHash := sim.Nodes[0].BlockChain.Tip()
+	for _, node := range sim.Nodes[1:] {
+		otherNextIndex, otherLastHash := node.BlockChain.Tip()
+		if otherNextIndex != nextIndex || otherLastHash != lastHash {
+			return false
+		}
+	}
+	return true
+}
+
+func (sim *Simulator) WaitConverged(timeout time.Duration) error {
+	return sim.WaitFor(timeout, sim.Converged)
+}
+
+func (sim *Simulator) WaitFor(timeout time.Duration, cond func() bool) error {
+	return waitFor(timeout, cond)
+}
+
+// polls @cond until it is true or @timeout has passed
+func waitFor(timeout time.Duration, cond func() bool) error {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return errors.New("Timeout waiting for the simulated network")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil
+}
+
+// transport of a single node of the simulator
+type simTransport struct {
+	sim  *Simulator
+	addr string // address the node listens on
+}
+
+func (transport *simTransport) Listen(addr string) (net.Listener, error) {
+	listener, err := transport.sim.Transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	transport.addr = listener.Addr().String()
+	return &simListener{listener, transport}, nil
+}
+
+func (transport *simTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if _, ok := transport.sim.link(transport.addr, addr); !ok {
+		return nil, errors.New("Connection refused")
+	}
+	conn, err := transport.sim.Transport.Dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	transport.sim.lock.Lock()
+	transport.sim.dialers[conn.LocalAddr().String()] = transport.addr
+	transport.sim.lock.Unlock()
+	return newSimConn(conn, transport.sim, transport.addr, addr), nil
+}
+
+func (transport *simTransport) ValidateAddr(addr string) error {
+	return transport.sim.Transport.ValidateAddr(addr)
+}
+
+type simListener struct {
+	net.Listener
+	transport *simTransport
+}
+
+func (listener *simListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newSimConn(conn, listener.transport.sim, listener.transport.addr, conn.RemoteAddr().String()), nil
+}
+
+type delayedWrite struct {
+	data []byte
+	at   time.Time
+}
+
+// connection that applies the link between its nodes to every write. Writes never
+// block, they are delivered in order by a goroutine after the latency of the link
+type simConn struct {
+	net.Conn
+	sim       *Simulator
+	from      string
+	to        string // the address of the listening node or of the dialing end
+	writes    chan delayedWrite
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSimConn(conn net.Conn, sim *Simulator, from string, to string) *simConn {
+	simConn := &simConn{conn, sim, from, to, make(chan delayedWrite, 4096), make(chan struct{}), sync.Once{}}
+	go simConn.deliver()
+	return simConn
+}
+
+func (conn *simConn) Write(b []byte) (int, error) {
+	link, ok := conn.sim.link(conn.from, conn.to)
+	if !ok || rand.Float64() < link.Loss {
+		return len(b), nil
+	}
+	data := append([]byte{}, b...)
+	select {
+	case conn.writes <- delayedWrite{data, time.Now().Add(link.Latency)}:
+		return len(b), nil
+	case <-conn.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (conn *simConn) deliver() {
+	for {
+		select {
+		case <-conn.done:
+			return
+		case write := <-conn.writes:
+			time.Sleep(time.Until(write.at))
+			_, err := conn.Conn.Write(write.data)
+			if err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (conn *simConn) Close() error {
+	conn.closeOnce.Do(func() { close(conn.done) })
+	return conn.Conn.Close()
+}
+
+// writes don't block, so only the read deadline is used
+func (conn *simConn) SetDeadline(t time.Time) error {
+	return conn.Conn.SetReadDeadline(t)
+}
+
+func (conn *simConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/impadalko/CES27Projeto/blockchain"
+	"github.com/impadalko/CES27Projeto/network"
+	"github.com/impadalko/CES27Projeto/sign"
+	"github.com/impadalko/CES27Projeto/util"
+)
+
+// configuration of the simulated nodes, with short intervals so failures are
+// detected quickly
+func simulatorConfig() network.Config {
+	config := network.DefaultConfig()
+	config.PingInterval = network.Duration(100 * time.Millisecond)
+	config.ReconnectInterval = network.Duration(100 * time.Millisecond)
+	config.BackoffMin = network.Duration(100 * time.Millisecond)
+	config.BackoffMax = network.Duration(500 * time.Millisecond)
+	config.AddrInterval = network.Duration(200 * time.Millisecond)
+	config.CallTimeout = network.Duration(2 * time.Second)
+	return config
+}
+
+func TestSimulatorConvergence() error {
+	sim, err := NewSimulator(5, simulatorConfig())
+	if err != nil {
+		return err
+	}
+	defer sim.Stop()
+	sim.DefaultLink = Link{Latency: 5 * time.Millisecond}
+	sim.SetLink(0, 4, Link{Latency: 50 * time.Millisecond, Loss: 0.1})
+
+	err = sim.WaitConverged(10 * time.Second)
+	if err != nil {
+		return err
+	}
+	err = sim.AddBlock(2, []byte{1})
+	if err != nil {
+		return err
+	}
+	err = sim.WaitConverged(10 * time.Second)
+	if err != nil {
+		return errors.New("Expected new block to reach all nodes")
+	}
+
+	// both partitions extend the blockchain, the longest one wins after healing
+	sim.Partition([]int{0, 1}, []int{2, 3, 4})
+	err = sim.WaitFor(10*time.Second, func() bool {
+		for _, a := range []int{0, 1} {
+			for _, b := range []int{2, 3, 4} {
+				if sim.Connected(a, b) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.New("Expected peers in other partitions to be evicted")
+	}
+	err = sim.AddBlock(0, []byte{2})
+	if err != nil {
+		return err
+	}
+	for _, data := range []byte{3, 4} {
+		err = sim.AddBlock(3, []byte{data})
+		if err != nil {
+			return err
+		}
+	}
+	if sim.Converged() {
+		return errors.New("Expected partitions to diverge")
+	}
+	sim.Heal()
+	err = sim.WaitConverged(10 * time.Second)
+	if err != nil {
+		return errors.New("Expected partitions to converge after healing")
+	}
+	// the block of the losing partition is added again by its author after the blocks of
+	// the winner
+	nextIndex, _ := sim.Nodes[0].BlockChain.Tip()
+	if nextIndex != 5 {
+		return errors.New("Expected the longest blockchain to win")
+	}
+	block, err := sim.Nodes[0].BlockChain.GetBlock(4)
+	if err != nil || !bytes.Equal(block.Data, []byte{2}) {
+		return errors.New("Expected the orphaned block to be added again")
+	}
+
+	return nil
+}
+
+// starts a node with an identity key that dials the nodes @peers
+func startDirectNode(nodeId string, peers ...*Node) (*Node, error) {
+	node := NewNode(nodeId)
+	identity, err := sign.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	node.Identity = identity
+	err = node.Listen()
+	if err != nil {
+		return nil, err
+	}
+	go node.Start()
+	for _, peer := range peers {
+		conn, err := node.Network.Dial(peer.Network.NodeAddr)
+		if err != nil {
+			return nil, err
+		}
+		go node.StartHandleConnection(conn)
+	}
+	return node, nil
+}
+
+func inbox(node *Node) []InboxMessage {
+	node.InboxLock.Lock()
+	defer node.InboxLock.Unlock()
+	return append([]InboxMessage{}, node.Inbox...)
+}
+
+func TestDirectMessages() error {
+	// nodes A and C are only connected through node B
+	nodeB, err := startDirectNode("B")
+	if err != nil {
+		return err
+	}
+	defer nodeB.Network.Shutdown()
+	nodeA, err := startDirectNode("A", nodeB)
+	if err != nil {
+		return err
+	}
+	defer nodeA.Network.Shutdown()
+	nodeC, err := startDirectNode("C", nodeB)
+	if err != nil {
+		return err
+	}
+	defer nodeC.Network.Shutdown()
+	wait := func(cond func() bool) error { return waitFor(5*time.Second, cond) }
+	err = wait(func() bool {
+		_, okA := nodeA.PeerKey("B")
+		_, okC := nodeC.PeerKey("B")
+		return okA && okC
+	})
+	if err != nil {
+		return errors.New("Expected identity keys to be exchanged")
+	}
+
+	// the message from A to C is relayed by B
+	err = nodeA.SendDirect("C", "hello", false)
+	if err != nil {
+		return err
+	}
+	err = wait(func() bool { return len(inbox(nodeC)) == 1 })
+	if err != nil {
+		return errors.New("Expected relayed message to be received")
+	}
+	if len(inbox(nodeB)) != 0 || inbox(nodeC)[0].From != "A" || inbox(nodeC)[0].Text != "hello" {
+		return errors.New("Inbox mismatch")
+	}
+
+	// C does not pin the key carried by a relayed message, so a node claiming to be A
+	// can't pin its own key before C learns the real one
+	if _, ok := nodeC.PeerKey("A"); ok || inbox(nodeC)[0].Verified {
+		return errors.New("Expected key of a relayed message not to be pinned")
+	}
+	forger, err := sign.GenerateKey()
+	if err != nil {
+		return err
+	}
+	forge := func(text string) error {
+		forged := &Direct{util.RandomString(16), "A", "C", util.Now(), false, []byte(text),
+			sign.PublicKeyToBytes(&forger.PublicKey), nil}
+		forged.Signature, err = sign.Sign(forger, forged.Digest())
+		if err != nil {
+			return err
+		}
+		return nodeB.Network.SendMessage("C", forged)
+	}
+	err = forge("fake")
+	if err != nil {
+		return err
+	}
+	err = wait(func() bool { return len(inbox(nodeC)) == 2 })
+	if err != nil {
+		return errors.New("Expected relayed message to be received")
+	}
+	if _, ok := nodeC.PeerKey("A"); ok || inbox(nodeC)[1].Verified {
+		return errors.New("Expected forged key not to be pinned")
+	}
+	if nodeC.SendDirect("A", "secret", true) == nil {
+		return errors.New("Expected encryption to an unknown key to fail")
+	}
+
+	// C connects to A and pins its key from its IDENTITY, then answers encrypted
+	conn, err := nodeC.Network.Dial(nodeA.Network.NodeAddr)
+	if err != nil {
+		return err
+	}
+	go nodeC.StartHandleConnection(conn)
+	err = wait(func() bool {
+		key, ok := nodeC.PeerKey("A")
+		return ok && keyString(key) == keyString(&nodeA.Identity.PublicKey)
+	})
+	if err != nil {
+		return errors.New("Expected key of a connected peer to be pinned")
+	}
+	err = nodeC.SendDirect("A", "secret", true)
+	if err != nil {
+		return err
+	}
+	err = wait(func() bool { return len(inbox(nodeA)) == 1 })
+	if err != nil {
+		return errors.New("Expected encrypted message to be received")
+	}
+	if received := inbox(nodeA)[0]; received.Text != "secret" || !received.Encrypted || !received.Verified {
+		return errors.New("Expected encrypted message to be decrypted")
+	}
+
+	// a message claiming to be from A, signed with another key, is now rejected by C
+	err = forge("fake again")
+	if err != nil {
+		return err
+	}
+	err = nodeA.SendDirect("C", "after", false)
+	if err != nil {
+		return err
+	}
+	err = wait(func() bool { return len(inbox(nodeC)) == 3 })
+	if err != nil {
+		return errors.New("Expected message after the forged one to be received")
+	}
+	if received := inbox(nodeC)[2]; received.Text != "after" || !received.Verified {
+		return errors.New("Expected forged message to be rejected")
+	}
+
+	return nil
+}
+
+func TestObserverNode() error {
+	// node A has a blockchain, node B observes it
+	nodeA := NewNode("A")
+	nodeA.BlockChain.Replace(blockchain.New(util.Now(), []byte{}))
+	_, err := nodeA.AddBlockFromData(util.Now(), []byte{1})
+	if err != nil {
+		return err
+	}
+	err = nodeA.Listen()
+	if err != nil {
+		return err
+	}
+	go nodeA.Start()
+	defer nodeA.Network.Shutdown()
+	nodeB := NewNode("B")
+	nodeB.Network.Config.Observer = true
+	err = nodeB.Listen()
+	if err != nil {
+		return err
+	}
+	go nodeB.Start()
+	defer nodeB.Network.Shutdown()
+	conn, err := nodeB.Network.Dial(nodeA.Network.NodeAddr)
+	if err != nil {
+		return err
+	}
+	go nodeB.StartHandleConnection(conn)
+
+	wait := func(cond func() bool) error { return waitFor(5*time.Second, cond) }
+	nextIndex := func(node *Node) int64 {
+		index, _ := node.BlockChain.Tip()
+		return index
+	}
+	err = wait(func() bool { return nextIndex(nodeB) == 2 })
+	if err != nil {
+		return errors.New("Expected observer to sync the blockchain")
+	}
+	_, err = nodeB.AddBlockFromData(util.Now(), []byte{2})
+	if err != network.ErrObserver {
+		return errors.New("Expected observer not to add blocks")
+	}
+
+	// a block pushed by the observer is dropped
+	blocks := []blockchain.Block{}
+	for index := int64(0); index < 2; index++ {
+		block, _ := nodeB.BlockChain.GetBlock(index)
+		blocks = append(blocks, block)
+	}
+	forged, err := blockchain.NewFromBlocks(blocks)
+	if err != nil {
+		return err
+	}
+	forged.AddBlockFromData(util.Now(), []byte{2})
+	block, _ := forged.GetBlock(2)
+	connA, _ := nodeB.Network.GetPeerConn("A")
+	connA.SendMessage(&BlockAdd{block})
+	err = wait(func() bool {
+		connB, ok := nodeA.Network.GetPeerConn("B")
+		if !ok {
+			return false
+		}
+		connB.Lock.RLock()
+		defer connB.Lock.RUnlock()
+		return connB.Score > 0
+	})
+	if err != nil || nextIndex(nodeA) != 2 {
+		return errors.New("Expected block from observer to be dropped")
+	}
+
+	// new blocks still reach the observer
+	_, err = nodeA.AddBlockFromData(util.Now(), []byte{3})
+	if err != nil {
+		return err
+	}
+	err = wait(func() bool { return nextIndex(nodeB) == 3 })
+	if err != nil {
+		return errors.New("Expected observer to receive new blocks")
+	}
+	received, _ := nodeB.BlockChain.GetBlock(2)
+	if !bytes.Equal(received.Data, []byte{3}) {
+		return errors.New("Block mismatch")
+	}
+	return nil
+}
+
+func TestBlockRelay() error {
+	// nodes A, B, C and D are connected in a ring, so C only learns about the blocks of A
+	// through B and D
+	nodeA, err := startDirectNode("A")
+	if err != nil {
+		return err
+	}
+	defer nodeA.Network.Shutdown()
+	nodeA.BlockChain.Replace(blockchain.New(util.Now(), []byte{}))
+	nodeB, err := startDirectNode("B", nodeA)
+	if err != nil {
+		return err
+	}
+	defer nodeB.Network.Shutdown()
+	nodeC, err := startDirectNode("C", nodeB)
+	if err != nil {
+		return err
+	}
+	defer nodeC.Network.Shutdown()
+	nodeD, err := startDirectNode("D", nodeC, nodeA)
+	if err != nil {
+		return err
+	}
+	defer nodeD.Network.Shutdown()
+	nodes := []*Node{nodeA, nodeB, nodeC, nodeD}
+
+	wait := func(cond func() bool) error { return waitFor(5*time.Second, cond) }
+	synced := func(nextIndex int64) bool {
+		for _, node := range nodes {
+			index, _ := node.BlockChain.Tip()
+			if index != nextIndex {
+				return false
+			}
+		}
+		return true
+	}
+	sentInv := func() int64 {
+		total := int64(0)
+		for i, node := range nodes {
+			for _, peer := range []*Node{nodes[(i+1)%4], nodes[(i+3)%4]} {
+				connInfo, ok := node.Network.GetPeerConn(peer.Network.NodeId)
+				if ok {
+					total += connInfo.Stats().OutByType["INV"].Messages
+				}
+			}
+		}
+		return total
+	}
+	err = wait(func() bool { return synced(1) })
+	if err != nil {
+		return errors.New("Expected nodes to sync the blockchain")
+	}
+
+	// the new block is announced without being requested and relayed to node C
+	before := sentInv()
+	_, err = nodeA.AddBlockFromData(util.Now(), []byte{1})
+	if err != nil {
+		return err
+	}
+	err = wait(func() bool { return synced(2) })
+	if err != nil {
+		return errors.New("Expected new block to be relayed to all nodes")
+	}
+	block, _ := nodeC.BlockChain.GetBlock(1)
+	if !bytes.Equal(block.Data, []byte{1}) {
+		return errors.New("Block mismatch")
+	}
+
+	// each node announces the block at most once to each of its 2 peers, and the
+	// announcements stop once every node has the block
+	time.Sleep(500 * time.Millisecond)
+	after := sentInv()
+	if after-before > 8 {
+		return errors.New("Expected block to be announced at most once to each peer")
+	}
+	time.Sleep(500 * time.Millisecond)
+	if sentInv() != after {
+		return errors.New("Expected block relay to stop")
+	}
+	return nil
+}
+
+func TestMembership() error {
+	// the admin node A starts the blockchain and adds node B as a member
+	admin, err := sign.GenerateKey()
+	if err != nil {
+		return err
+	}
+	start := func(nodeId string, identity *rsa.PrivateKey) (*Node, error) {
+		node := NewNode(nodeId)
+		node.Identity = identity
+		node.AdminKey = &admin.PublicKey
+		err := node.Listen()
+		if err != nil {
+			return nil, err
+		}
+		go node.Start()
+		return node, nil
+	}
+	join := func(node *Node, peer *Node) error {
+		conn, err := node.Network.Dial(peer.Network.NodeAddr)
+		if err != nil {
+			return err
+		}
+		go node.StartHandleConnection(conn)
+		return nil
+	}
+	authenticated := func(node *Node, peerId string) bool {
+		connInfo, ok := node.Network.GetPeerConn(peerId)
+		if !ok {
+			return false
+		}
+		_, ok = node.PeerIdentity(connInfo)
+		return ok
+	}
+	wait := func(cond func() bool) error { return waitFor(5*time.Second, cond) }
+
+	nodeA, err := start("A", admin)
+	if err != nil {
+		return err
+	}
+	defer nodeA.Network.Shutdown()
+	nodeA.BlockChain.Replace(blockchain.New(util.Now(), []byte{}))
+	identityB, err := sign.GenerateKey()
+	if err != nil {
+		return err
+	}
+	_, err = nodeA.AddMemberRecord(AddMember, &identityB.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	// node B authenticates and syncs the blockchain
+	nodeB, err := start("B", identityB)
+	if err != nil {
+		return err
+	}
+	defer nodeB.Network.Shutdown()
+	err = join(nodeB, nodeA)
+	if err != nil {
+		return err
+	}
+	err = wait(func() bool {
+		nextIndex, _ := nodeB.BlockChain.Tip()
+		return authenticated(nodeA, "B") && authenticated(nodeB, "A") && nextIndex == 2
+	})
+	if err != nil {
+		return errors.New("Expected member to join")
+	}
+
+	// records are only valid when signed by the admin
+	identityC, err := sign.GenerateKey()
+	if err != nil {
+		return err
+	}
+	_, err = nodeB.AddMemberRecord(AddMember, &identityC.PublicKey)
+	if err == nil {
+		return errors.New("Expected only the admin to change the members")
+	}
+	forged := &MemberRecord{AddMember, "forged-record-id", sign.PublicKeyToBytes(&identityC.PublicKey), nil}
+	forged.Signature, err = sign.Sign(identityB, forged.Digest())
+	if err != nil {
+		return err
+	}
+	_, err = nodeB.AddBlockFromData(util.Now(), forged.Bytes())
+	if err != nil {
+		return err
+	}
+	err = wait(func() bool {
+		nextIndex, _ := nodeA.BlockChain.Tip()
+		return nextIndex == 3
+	})
+	if err != nil {
+		return err
+	}
+	if nodeA.IsMember(&identityC.PublicKey) {
+		return errors.New("Expected forged record to be ignored")
+	}
+
+	// node C is not a member
+	nodeC, err := start("C", identityC)
+	if err != nil {
+		return err
+	}
+	defer nodeC.Network.Shutdown()
+	err = join(nodeC, nodeA)
+	if err != nil {
+		return err
+	}
+	err = wait(func() bool { return nodeC.Network.CountPeers() == 0 && !authenticated(nodeA, "C") })
+	if err != nil {
+		return errors.New("Expected non member to be rejected")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := nodeA.Network.GetPeerConn("C"); ok {
+		return errors.New("Expected non member to be disconnected")
+	}
+
+	// node D joins through node E, a non member with its own blockchain. D can't check
+	// the members before it syncs, so it does not sync from E until it joins the admin
+	identityD, err := sign.GenerateKey()
+	if err != nil {
+		return err
+	}
+	_, err = nodeA.AddMemberRecord(AddMember, &identityD.PublicKey)
+	if err != nil {
+		return err
+	}
+	nodeE := NewNode("E")
+	nodeE.Identity = identityC
+	nodeE.BlockChain.Replace(blockchain.New(util.Now(), []byte{7}))
+	err = nodeE.Listen()
+	if err != nil {
+		return err
+	}
+	go nodeE.Start()
+	defer nodeE.Network.Shutdown()
+	nodeD, err := start("D", identityD)
+	if err != nil {
+		return err
+	}
+	defer nodeD.Network.Shutdown()
+	err = join(nodeD, nodeE)
+	if err != nil {
+		return err
+	}
+	err = wait(func() bool {
+		connInfo, ok := nodeD.Network.GetPeerConn("E")
+		if !ok {
+			return false
+		}
+		nodeD.AuthLock.Lock()
+		defer nodeD.AuthLock.Unlock()
+		auth, ok := nodeD.Auth[connInfo]
+		return ok && auth.key != nil
+	})
+	if err != nil {
+		return errors.New("Expected non member to answer the challenge")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, ok := nodeD.BlockChain.ChainId(); ok || authenticated(nodeD, "E") {
+		return errors.New("Expected unverified peer not to be synced from")
+	}
+	err = join(nodeD, nodeA)
+	if err != nil {
+		return err
+	}
+	err = wait(func() bool {
+		nextIndex, _ := nodeD.BlockChain.Tip()
+		_, connected := nodeD.Network.GetPeerConn("E")
+		return authenticated(nodeD, "A") && nextIndex == 4 && !connected
+	})
+	if err != nil {
+		return errors.New("Expected member to sync from the admin and drop the non member")
+	}
+
+	// removing node B drops the connections to it, and replaying the record that added
+	// it has no effect
+	nodeA.BlockChain.Lock.RLock()
+	added := nodeA.BlockChain.Blocks[1].Data
+	nodeA.BlockChain.Lock.RUnlock()
+	_, err = nodeA.AddMemberRecord(RemoveMember, &identityB.PublicKey)
+	if err != nil {
+		return err
+	}
+	err = wait(func() bool {
+		_, connected := nodeA.Network.GetPeerConn("B")
+		return !connected && nodeB.Network.CountPeers() == 0
+	})
+	if err != nil {
+		return errors.New("Expected removed member to be disconnected")
+	}
+	_, err = nodeA.AddBlockFromData(util.Now(), added)
+	if err != nil {
+		return err
+	}
+	if nodeA.IsMember(&identityB.PublicKey) || !nodeA.IsMember(&admin.PublicKey) {
+		return errors.New("Expected replayed record to be ignored")
+	}
+
+	// a non member dials the admin claiming to be node T and dials node T claiming to be
+	// the admin, then relays the challenge of T to the admin and its answer back to T
+	identityT, err := sign.GenerateKey()
+	if err != nil {
+		return err
+	}
+	_, err = nodeA.AddMemberRecord(AddMember, &identityT.PublicKey)
+	if err != nil {
+		return err
+	}
+	nodeT, err := start("T", identityT)
+	if err != nil {
+		return err
+	}
+	defer nodeT.Network.Shutdown()
+	relayA, relayT := network.NewNode("T"), network.NewNode("A")
+	answered := int32(0)
+	relayA.AddHandler(network.MessageDef{
+		New:    func() network.Message { return &AuthChallenge{} },
+		Handle: func(ctx *network.Context, msg network.Message) error { return nil },
+	})
+	relayA.AddHandler(network.MessageDef{
+		New: func() network.Message { return &Auth{} },
+		Handle: func(ctx *network.Context, msg network.Message) error {
+			atomic.StoreInt32(&answered, 1)
+			connInfo, _ := relayT.GetPeerConn("T")
+			return connInfo.SendMessage(msg)
+		},
+	})
+	relayT.AddHandler(network.MessageDef{
+		New: func() network.Message { return &AuthChallenge{} },
+		Handle: func(ctx *network.Context, msg network.Message) error {
+			connInfo, _ := relayA.GetPeerConn("A")
+			return connInfo.SendMessage(msg)
+		},
+	})
+	relayT.AddHandler(network.MessageDef{
+		New:    func() network.Message { return &Auth{} },
+		Handle: func(ctx *network.Context, msg network.Message) error { return nil },
+	})
+	for _, relay := range []struct {
+		network *network.Network
+		peer    *Node
+	}{{relayA, nodeA}, {relayT, nodeT}} {
+		err = relay.network.Listen()
+		if err != nil {
+			return err
+		}
+		go relay.network.Start()
+		defer relay.network.Shutdown()
+		conn, err := relay.network.Dial(relay.peer.Network.NodeAddr)
+		if err != nil {
+			return err
+		}
+		go relay.network.StartHandleConnection(conn)
+		err = wait(func() bool {
+			_, ok := relay.network.GetPeerConn(relay.peer.Network.NodeId)
+			return ok
+		})
+		if err != nil {
+			return err
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	if atomic.LoadInt32(&answered) != 0 || authenticated(nodeT, "A") {
+		return errors.New("Expected relayed challenge not to be answered")
+	}
+	return nil
+}